@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var unitRegexp = regexp.MustCompile(`^[\d.]+ [KMGT]?i?(.+)$`)
+
+// Identifiers and versions which look like numbers but are kept as strings,
+// such as the hexadecimal PCI IDs, whatever their digits.
+var identifierRegexp = regexp.MustCompile(`^(id|serial|minor_number|gpu_part_number|pid|pci_.*|.*_id|.*_version|.*_object)$`)
+
+// normalizeValue converts an nvidia-smi value to a number, a number with its
+// unit in base units such as {"value": 4236247040, "unit": "B"} for 4040 MiB,
+// or null when not available. Other values are kept as is.
+func normalizeValue(value string) interface{} {
+	if value == "N/A" || value == "" {
+		return nil
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	if match := unitRegexp.FindStringSubmatch(value); match != nil {
+		number, _ := strconv.ParseFloat(filterUnit(value), 64)
+		return map[string]interface{}{"value": number, "unit": match[1]}
+	}
+	return value
+}
+
+// normalize converts the parsed XML into JSON values, keyed by the XML
+// element names.
+func normalize(name string, v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.String:
+		if identifierRegexp.MatchString(name) && v.String() != "N/A" {
+			return v.String()
+		}
+		return normalizeValue(v.String())
+	case reflect.Slice:
+		result := make([]interface{}, v.Len())
+		for i := range result {
+			result[i] = normalize(name, v.Index(i))
+		}
+		return result
+	case reflect.Struct:
+		result := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("xml"), ",")
+			if name != "" {
+				result[name] = normalize(name, v.Field(i))
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func normalizeGPU(GPU GPUInfo) interface{} {
+	processes := make([]ProcessInfo, len(GPU.Processes.ProcessInfo))
+	for i, Process := range GPU.Processes.ProcessInfo {
+		Process.ProcessName = sanitizeProcessName(Process.Pid, Process.ProcessName)
+		processes[i] = Process
+	}
+	GPU.Processes.ProcessInfo = processes
+	return normalize("gpu", reflect.ValueOf(GPU))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func gpusAPI(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /api/v1/gpus")
+
+	xmlData, err := queryNvidiaSmi()
+	if err != nil {
+		logQueryError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gpus := make([]interface{}, 0, len(xmlData.GPU))
+	for _, GPU := range xmlData.GPU {
+		gpus = append(gpus, normalizeGPU(GPU))
+	}
+	writeJSON(w, map[string]interface{}{
+		"driver_version": xmlData.DriverVersion,
+		"cuda_version":   xmlData.CudaVersion,
+		"attached_gpus":  normalizeValue(xmlData.AttachedGPUs),
+		"gpus":           gpus,
+	})
+}
+
+func gpuAPI(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /api/v1/gpus/{uuid}")
+
+	xmlData, err := queryNvidiaSmi()
+	if err != nil {
+		logQueryError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uuid := r.PathValue("uuid")
+	for _, GPU := range xmlData.GPU {
+		if strings.EqualFold(GPU.UUID, uuid) {
+			writeJSON(w, normalizeGPU(GPU))
+			return
+		}
+	}
+	http.Error(w, "GPU "+uuid+" not found", http.StatusNotFound)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// apiServer serves the JSON API over the sample report.
+func apiServer(t *testing.T) func(target string) *httptest.ResponseRecorder {
+	t.Helper()
+	mode := testMode
+	t.Cleanup(func() { testMode = mode })
+	testMode = "1"
+	t.Chdir("..")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/gpus", gpusAPI)
+	mux.HandleFunc("/api/v1/gpus/{uuid}", gpuAPI)
+	return func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+}
+
+func TestGPUsAPI(t *testing.T) {
+	recorder := apiServer(t)("/api/v1/gpus")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d, content type %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["attached_gpus"] != 1.0 || response["driver_version"] != "440.95.01" {
+		t.Errorf("got attached GPUs %v, driver version %v", response["attached_gpus"], response["driver_version"])
+	}
+	gpus := response["gpus"].([]interface{})
+	if len(gpus) != 1 {
+		t.Fatalf("got %d GPUs, want 1", len(gpus))
+	}
+	GPU := gpus[0].(map[string]interface{})
+	pci := GPU["pci"].(map[string]interface{})
+
+	// Identifiers keep their digits, whether or not they look like numbers
+	identifiers := map[string]interface{}{
+		"minor_number":      GPU["minor_number"],
+		"board_id":          GPU["board_id"],
+		"vbios_version":     GPU["vbios_version"],
+		"pci_bus":           pci["pci_bus"],
+		"pci_device":        pci["pci_device"],
+		"pci_domain":        pci["pci_domain"],
+		"pci_device_id":     pci["pci_device_id"],
+		"pci_bus_id":        pci["pci_bus_id"],
+		"pci_sub_system_id": pci["pci_sub_system_id"],
+	}
+	want := map[string]interface{}{
+		"minor_number":      "0",
+		"board_id":          "0x100",
+		"vbios_version":     "84.04.31.00.F6",
+		"pci_bus":           "01",
+		"pci_device":        "00",
+		"pci_domain":        "0000",
+		"pci_device_id":     "13C010DE",
+		"pci_bus_id":        "00000000:01:00.0",
+		"pci_sub_system_id": "31701462",
+	}
+	if !reflect.DeepEqual(identifiers, want) {
+		t.Errorf("got identifiers %v, want %v", identifiers, want)
+	}
+
+	// Other values are numbers, with their unit if any, or null
+	if pci["replay_counter"] != 0.0 {
+		t.Errorf("replay_counter is %#v, want 0", pci["replay_counter"])
+	}
+	if got := pci["tx_util"]; !reflect.DeepEqual(got, map[string]interface{}{"value": 28000000.0, "unit": "B/s"}) {
+		t.Errorf("tx_util is %#v", got)
+	}
+	if got := GPU["fan_speed"]; !reflect.DeepEqual(got, map[string]interface{}{"value": 0.0, "unit": "%"}) {
+		t.Errorf("fan_speed is %#v", got)
+	}
+	if GPU["serial"] != nil {
+		t.Errorf("serial is %#v, want null", GPU["serial"])
+	}
+	process := GPU["processes"].(map[string]interface{})["process_info"].([]interface{})[0].(map[string]interface{})
+	if process["pid"] != "2125" {
+		t.Errorf("pid is %#v, want \"2125\"", process["pid"])
+	}
+}
+
+func TestGPUAPI(t *testing.T) {
+	serve := apiServer(t)
+	recorder := serve("/api/v1/gpus/gpu-CF5CE50C-9D96-5DA7-ADB6-B662D5AFE4BC")
+	var GPU map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &GPU); err != nil {
+		t.Fatal(err)
+	}
+	if GPU["uuid"] != "GPU-cf5ce50c-9d96-5da7-adb6-b662d5afe4bc" {
+		t.Errorf("got GPU %v", GPU["uuid"])
+	}
+
+	recorder = serve("/api/v1/gpus/GPU-unknown")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown GPU, want 404", recorder.Code)
+	}
+}
@@ -8,262 +8,347 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const LISTEN_ADDRESS = ":9202"
 const NVIDIA_SMI_PATH = "/usr/bin/nvidia-smi"
 
 var testMode string
+var processMetricsEnabled bool
 
 type NvidiaSmiLog struct {
-	DriverVersion string `xml:"driver_version"`
-	CudaVersion   string `xml:"cuda_version"`
-	AttachedGPUs  string `xml:"attached_gpus"`
-	GPU           []struct {
-		Id                       string `xml:"id,attr"`
-		ProductName              string `xml:"product_name"`
-		ProductBrand             string `xml:"product_brand"`
-		DisplayMode              string `xml:"display_mode"`
-		DisplayActive            string `xml:"display_active"`
-		PersistenceMode          string `xml:"persistence_mode"`
-		AccountingMode           string `xml:"accounting_mode"`
-		AccountingModeBufferSize string `xml:"accounting_mode_buffer_size"`
-		DriverModel              struct {
-			CurrentDM string `xml:"current_dm"`
-			PendingDM string `xml:"pending_dm"`
-		} `xml:"driver_model"`
-		Serial         string `xml:"serial"`
-		UUID           string `xml:"uuid"`
-		MinorNumber    string `xml:"minor_number"`
-		VbiosVersion   string `xml:"vbios_version"`
-		MultiGPUBoard  string `xml:"multigpu_board"`
-		BoardId        string `xml:"board_id"`
-		GPUPartNumber  string `xml:"gpu_part_number"`
-		InfoRomVersion struct {
-			ImgVersion string `xml:"img_version"`
-			OemObject  string `xml:"oem_object"`
-			EccObject  string `xml:"ecc_object"`
-			PwrObject  string `xml:"pwr_object"`
-		} `xml:"inforom_version"`
-		GPUOperationMode struct {
-			Current string `xml:"current_gom"`
-			Pending string `xml:"pending_gom"`
-		} `xml:"gpu_operation_mode"`
-		GPUVirtualizationMode struct {
-			VirtualizationMode string `xml:"virtualization_mode"`
-			HostVGPUMode       string `xml:"host_vgpu_mode"`
-		} `xml:"gpu_virtualization_mode"`
-		IBMNPU struct {
-			RelaxedOrderingMode string `xml:"relaxed_ordering_mode"`
-		} `xml:"ibmnpu"`
-		PCI struct {
-			Bus         string `xml:"pci_bus"`
-			Device      string `xml:"pci_device"`
-			Domain      string `xml:"pci_domain"`
-			DeviceId    string `xml:"pci_device_id"`
-			BusId       string `xml:"pci_bus_id"`
-			SubSystemId string `xml:"pci_sub_system_id"`
-			GPULinkInfo struct {
-				PCIeGen struct {
-					Max     string `xml:"max_link_gen"`
-					Current string `xml:"current_link_gen"`
-				} `xml:"pcie_gen"`
-				LinkWidth struct {
-					Max     string `xml:"max_link_width"`
-					Current string `xml:"current_link_width"`
-				} `xml:"link_widths"`
-			} `xml:"pci_gpu_link_info"`
-			BridgeChip struct {
-				Type string `xml:"bridge_chip_type"`
-				Fw   string `xml:"bridge_chip_fw"`
-			} `xml:"pci_bridge_chip"`
-			ReplayCounter         string `xml:"replay_counter"`
-			ReplayRolloverCounter string `xml:"replay_rollover_counter"`
-			TxUtil                string `xml:"tx_util"`
-			RxUtil                string `xml:"rx_util"`
-		} `xml:"pci"`
-		FanSpeed         string `xml:"fan_speed"`
-		PerformanceState string `xml:"performance_state"`
-		// <clocks_throttle_reasons>
-		// 	    <clocks_throttle_reason_gpu_idle>Not Active</clocks_throttle_reason_gpu_idle>
-		// 	    <clocks_throttle_reason_applications_clocks_setting>Not Active</clocks_throttle_reason_applications_clocks_setting>
-		// 	    <clocks_throttle_reason_sw_power_cap>Not Active</clocks_throttle_reason_sw_power_cap>
-		// 	    <clocks_throttle_reason_hw_slowdown>Not Active</clocks_throttle_reason_hw_slowdown>
-		// 	    <clocks_throttle_reason_hw_thermal_slowdown>N/A</clocks_throttle_reason_hw_thermal_slowdown>
-		// 	    <clocks_throttle_reason_hw_power_brake_slowdown>N/A</clocks_throttle_reason_hw_power_brake_slowdown>
-		// 	    <clocks_throttle_reason_sync_boost>Not Active</clocks_throttle_reason_sync_boost>
-		// 	    <clocks_throttle_reason_sw_thermal_slowdown>Not Active</clocks_throttle_reason_sw_thermal_slowdown>
-		// 	    <clocks_throttle_reason_display_clocks_setting>Not Active</clocks_throttle_reason_display_clocks_setting>
-		// </clocks_throttle_reasons>
-		FbMemoryUsage struct {
-			Total string `xml:"total"`
-			Used  string `xml:"used"`
-			Free  string `xml:"free"`
-		} `xml:"fb_memory_usage"`
-		Bar1MemoryUsage struct {
-			Total string `xml:"total"`
-			Used  string `xml:"used"`
-			Free  string `xml:"free"`
-		} `xml:"bar1_memory_usage"`
-		ComputeMode string `xml:"compute_mode"`
-		Utilization struct {
-			GPUUtil     string `xml:"gpu_util"`
-			MemoryUtil  string `xml:"memory_util"`
-			EncoderUtil string `xml:"encoder_util"`
-			DecoderUtil string `xml:"decoder_util"`
-		} `xml:"utilization"`
-		EncoderStats struct {
-			SessionCount   string `xml:"session_count"`
-			AverageFPS     string `xml:"average_fps"`
-			AverageLatency string `xml:"average_latency"`
-		} `xml:"encoder_stats"`
-		FBCStats struct {
-			SessionCount   string `xml:"session_count"`
-			AverageFPS     string `xml:"average_fps"`
-			AverageLatency string `xml:"average_latency"`
-		} `xml:"fbc_stats"`
-		// <ecc_mode>
-		//     <current_ecc>N/A</current_ecc>
-		//     <pending_ecc>N/A</pending_ecc>
-		// </ecc_mode>
-		// <ecc_errors>
-		//     <volatile>
-		//         <single_bit>
-		//             <device_memory>N/A</device_memory>
-		//             <register_file>N/A</register_file>
-		//             <l1_cache>N/A</l1_cache>
-		//             <l2_cache>N/A</l2_cache>
-		//             <texture_memory>N/A</texture_memory>
-		//             <texture_shm>N/A</texture_shm>
-		//             <cbu>N/A</cbu>
-		//             <total>N/A</total>
-		//         </single_bit>
-		//         <double_bit>
-		//             <device_memory>N/A</device_memory>
-		//             <register_file>N/A</register_file>
-		//             <l1_cache>N/A</l1_cache>
-		//             <l2_cache>N/A</l2_cache>
-		//             <texture_memory>N/A</texture_memory>
-		//             <texture_shm>N/A</texture_shm>
-		//             <cbu>N/A</cbu>
-		//             <total>N/A</total>
-		//         </double_bit>
-		//     </volatile>
-		//     <aggregate>
-		//         <single_bit>
-		//             <device_memory>N/A</device_memory>
-		//             <register_file>N/A</register_file>
-		//             <l1_cache>N/A</l1_cache>
-		//             <l2_cache>N/A</l2_cache>
-		//             <texture_memory>N/A</texture_memory>
-		//             <texture_shm>N/A</texture_shm>
-		//             <cbu>N/A</cbu>
-		//             <total>N/A</total>
-		//         </single_bit>
-		//         <double_bit>
-		//             <device_memory>N/A</device_memory>
-		//             <register_file>N/A</register_file>
-		//             <l1_cache>N/A</l1_cache>
-		//             <l2_cache>N/A</l2_cache>
-		//             <texture_memory>N/A</texture_memory>
-		//             <texture_shm>N/A</texture_shm>
-		//             <cbu>N/A</cbu>
-		//             <total>N/A</total>
-		//         </double_bit>
-		//     </aggregate>
-		// </ecc_errors>
-		// <retired_pages>
-		//     <multiple_single_bit_retirement>
-		//         <retired_count>N/A</retired_count>
-		//         <retired_pagelist>N/A</retired_pagelist>
-		//     </multiple_single_bit_retirement>
-		//     <double_bit_retirement>
-		//         <retired_count>N/A</retired_count>
-		//         <retired_pagelist>N/A</retired_pagelist>
-		//     </double_bit_retirement>
-		//     <pending_blacklist>N/A</pending_blacklist>
-		//     <pending_retirement>N/A</pending_retirement>
-		// </retired_pages>
-		Temperature struct {
-			GPUTemp                string `xml:"gpu_temp"`
-			GPUTempMaxThreshold    string `xml:"gpu_temp_max_threshold"`
-			GPUTempSlowThreshold   string `xml:"gpu_temp_slow_threshold"`
-			GPUTempMaxGpuThreshold string `xml:"gpu_temp_max_gpu_threshold"`
-			MemoryTemp             string `xml:"memory_temp"`
-			GPUTempMaxMemThreshold string `xml:"gpu_temp_max_mem_threshold"`
-		} `xml:"temperature"`
-		PowerReadings struct {
-			PowerState         string `xml:"power_state"`
-			PowerDraw          string `xml:"power_draw"`
-			PowerLimit         string `xml:"power_limit"`
-			DefaultPowerLimit  string `xml:"default_power_limit"`
-			EnforcedPowerLimit string `xml:"enforced_power_limit"`
-			MinPowerLimit      string `xml:"min_power_limit"`
-			MaxPowerLimit      string `xml:"max_power_limit"`
-		} `xml:"power_readings"`
-		Clocks struct {
-			GraphicsClock string `xml:"graphics_clock"`
-			SmClock       string `xml:"sm_clock"`
-			MemClock      string `xml:"mem_clock"`
-			VideoClock    string `xml:"video_clock"`
-		} `xml:"clocks"`
-		// <applications_clocks>
-		// 	<graphics_clock>1190 MHz</graphics_clock>
-		// 	<mem_clock>3505 MHz</mem_clock>
-		// </applications_clocks>
-		// <default_applications_clocks>
-		// 	<graphics_clock>1190 MHz</graphics_clock>
-		// 	<mem_clock>3505 MHz</mem_clock>
-		// </default_applications_clocks>
-		MaxClocks struct {
-			GraphicsClock string `xml:"graphics_clock"`
-			SmClock       string `xml:"sm_clock"`
-			MemClock      string `xml:"mem_clock"`
-			VideoClock    string `xml:"video_clock"`
-		} `xml:"max_clocks"`
-		// <max_customer_boost_clocks>
-		// 	<graphics_clock>N/A</graphics_clock>
-		// </max_customer_boost_clocks>
-		ClockPolicy struct {
-			AutoBoost        string `xml:"auto_boost"`
-			AutoBoostDefault string `xml:"auto_boost_default"`
-		} `xml:"clock_policy"`
-		// <supported_clocks>
-		//     <supported_mem_clock>
-		//         [...]
-		//     </supported_mem_clock>
-		// </supported_clocks>
-		Processes struct {
-			ProcessInfo []struct {
-				Pid         string `xml:"pid"`
-				Type        string `xml:"type"`
-				ProcessName string `xml:"process_name"`
-				UsedMemory  string `xml:"used_memory"`
-			} `xml:"process_info"`
-		} `xml:"processes"`
-		// <accounted_processes>
-		// </accounted_processes>
-	} `xml:"gpu"`
+	DriverVersion string    `xml:"driver_version"`
+	CudaVersion   string    `xml:"cuda_version"`
+	AttachedGPUs  string    `xml:"attached_gpus"`
+	GPU           []GPUInfo `xml:"gpu"`
 }
 
-func formatVersion(key string, meta string, value string) string {
+type GPUInfo struct {
+	Id                       string `xml:"id,attr"`
+	ProductName              string `xml:"product_name"`
+	ProductBrand             string `xml:"product_brand"`
+	DisplayMode              string `xml:"display_mode"`
+	DisplayActive            string `xml:"display_active"`
+	PersistenceMode          string `xml:"persistence_mode"`
+	AccountingMode           string `xml:"accounting_mode"`
+	AccountingModeBufferSize string `xml:"accounting_mode_buffer_size"`
+	DriverModel              struct {
+		CurrentDM string `xml:"current_dm"`
+		PendingDM string `xml:"pending_dm"`
+	} `xml:"driver_model"`
+	Serial         string `xml:"serial"`
+	UUID           string `xml:"uuid"`
+	MinorNumber    string `xml:"minor_number"`
+	VbiosVersion   string `xml:"vbios_version"`
+	MultiGPUBoard  string `xml:"multigpu_board"`
+	BoardId        string `xml:"board_id"`
+	GPUPartNumber  string `xml:"gpu_part_number"`
+	InfoRomVersion struct {
+		ImgVersion string `xml:"img_version"`
+		OemObject  string `xml:"oem_object"`
+		EccObject  string `xml:"ecc_object"`
+		PwrObject  string `xml:"pwr_object"`
+	} `xml:"inforom_version"`
+	GPUOperationMode struct {
+		Current string `xml:"current_gom"`
+		Pending string `xml:"pending_gom"`
+	} `xml:"gpu_operation_mode"`
+	GPUVirtualizationMode struct {
+		VirtualizationMode string `xml:"virtualization_mode"`
+		HostVGPUMode       string `xml:"host_vgpu_mode"`
+	} `xml:"gpu_virtualization_mode"`
+	IBMNPU struct {
+		RelaxedOrderingMode string `xml:"relaxed_ordering_mode"`
+	} `xml:"ibmnpu"`
+	PCI struct {
+		Bus         string `xml:"pci_bus"`
+		Device      string `xml:"pci_device"`
+		Domain      string `xml:"pci_domain"`
+		DeviceId    string `xml:"pci_device_id"`
+		BusId       string `xml:"pci_bus_id"`
+		SubSystemId string `xml:"pci_sub_system_id"`
+		GPULinkInfo struct {
+			PCIeGen struct {
+				Max     string `xml:"max_link_gen"`
+				Current string `xml:"current_link_gen"`
+			} `xml:"pcie_gen"`
+			LinkWidth struct {
+				Max     string `xml:"max_link_width"`
+				Current string `xml:"current_link_width"`
+			} `xml:"link_widths"`
+		} `xml:"pci_gpu_link_info"`
+		BridgeChip struct {
+			Type string `xml:"bridge_chip_type"`
+			Fw   string `xml:"bridge_chip_fw"`
+		} `xml:"pci_bridge_chip"`
+		ReplayCounter         string `xml:"replay_counter"`
+		ReplayRolloverCounter string `xml:"replay_rollover_counter"`
+		TxUtil                string `xml:"tx_util"`
+		RxUtil                string `xml:"rx_util"`
+	} `xml:"pci"`
+	FanSpeed              string                `xml:"fan_speed"`
+	PerformanceState      string                `xml:"performance_state"`
+	ClocksThrottleReasons ClocksThrottleReasons `xml:"clocks_throttle_reasons"`
+	ClocksEventReasons    ClocksEventReasons    `xml:"clocks_event_reasons"`
+	FbMemoryUsage         struct {
+		Total string `xml:"total"`
+		Used  string `xml:"used"`
+		Free  string `xml:"free"`
+	} `xml:"fb_memory_usage"`
+	Bar1MemoryUsage struct {
+		Total string `xml:"total"`
+		Used  string `xml:"used"`
+		Free  string `xml:"free"`
+	} `xml:"bar1_memory_usage"`
+	ComputeMode string `xml:"compute_mode"`
+	Utilization struct {
+		GPUUtil     string `xml:"gpu_util"`
+		MemoryUtil  string `xml:"memory_util"`
+		EncoderUtil string `xml:"encoder_util"`
+		DecoderUtil string `xml:"decoder_util"`
+	} `xml:"utilization"`
+	EncoderStats struct {
+		SessionCount   string `xml:"session_count"`
+		AverageFPS     string `xml:"average_fps"`
+		AverageLatency string `xml:"average_latency"`
+	} `xml:"encoder_stats"`
+	FBCStats struct {
+		SessionCount   string `xml:"session_count"`
+		AverageFPS     string `xml:"average_fps"`
+		AverageLatency string `xml:"average_latency"`
+	} `xml:"fbc_stats"`
+	// <ecc_mode>
+	//     <current_ecc>N/A</current_ecc>
+	//     <pending_ecc>N/A</pending_ecc>
+	// </ecc_mode>
+	// <ecc_errors>
+	//     <volatile>
+	//         <single_bit>
+	//             <device_memory>N/A</device_memory>
+	//             <register_file>N/A</register_file>
+	//             <l1_cache>N/A</l1_cache>
+	//             <l2_cache>N/A</l2_cache>
+	//             <texture_memory>N/A</texture_memory>
+	//             <texture_shm>N/A</texture_shm>
+	//             <cbu>N/A</cbu>
+	//             <total>N/A</total>
+	//         </single_bit>
+	//         <double_bit>
+	//             <device_memory>N/A</device_memory>
+	//             <register_file>N/A</register_file>
+	//             <l1_cache>N/A</l1_cache>
+	//             <l2_cache>N/A</l2_cache>
+	//             <texture_memory>N/A</texture_memory>
+	//             <texture_shm>N/A</texture_shm>
+	//             <cbu>N/A</cbu>
+	//             <total>N/A</total>
+	//         </double_bit>
+	//     </volatile>
+	//     <aggregate>
+	//         <single_bit>
+	//             <device_memory>N/A</device_memory>
+	//             <register_file>N/A</register_file>
+	//             <l1_cache>N/A</l1_cache>
+	//             <l2_cache>N/A</l2_cache>
+	//             <texture_memory>N/A</texture_memory>
+	//             <texture_shm>N/A</texture_shm>
+	//             <cbu>N/A</cbu>
+	//             <total>N/A</total>
+	//         </single_bit>
+	//         <double_bit>
+	//             <device_memory>N/A</device_memory>
+	//             <register_file>N/A</register_file>
+	//             <l1_cache>N/A</l1_cache>
+	//             <l2_cache>N/A</l2_cache>
+	//             <texture_memory>N/A</texture_memory>
+	//             <texture_shm>N/A</texture_shm>
+	//             <cbu>N/A</cbu>
+	//             <total>N/A</total>
+	//         </double_bit>
+	//     </aggregate>
+	// </ecc_errors>
+	// <retired_pages>
+	//     <multiple_single_bit_retirement>
+	//         <retired_count>N/A</retired_count>
+	//         <retired_pagelist>N/A</retired_pagelist>
+	//     </multiple_single_bit_retirement>
+	//     <double_bit_retirement>
+	//         <retired_count>N/A</retired_count>
+	//         <retired_pagelist>N/A</retired_pagelist>
+	//     </double_bit_retirement>
+	//     <pending_blacklist>N/A</pending_blacklist>
+	//     <pending_retirement>N/A</pending_retirement>
+	// </retired_pages>
+	Temperature struct {
+		GPUTemp                string `xml:"gpu_temp"`
+		GPUTempMaxThreshold    string `xml:"gpu_temp_max_threshold"`
+		GPUTempSlowThreshold   string `xml:"gpu_temp_slow_threshold"`
+		GPUTempMaxGpuThreshold string `xml:"gpu_temp_max_gpu_threshold"`
+		MemoryTemp             string `xml:"memory_temp"`
+		GPUTempMaxMemThreshold string `xml:"gpu_temp_max_mem_threshold"`
+	} `xml:"temperature"`
+	PowerReadings struct {
+		PowerState         string `xml:"power_state"`
+		PowerDraw          string `xml:"power_draw"`
+		PowerLimit         string `xml:"power_limit"`
+		DefaultPowerLimit  string `xml:"default_power_limit"`
+		EnforcedPowerLimit string `xml:"enforced_power_limit"`
+		MinPowerLimit      string `xml:"min_power_limit"`
+		MaxPowerLimit      string `xml:"max_power_limit"`
+	} `xml:"power_readings"`
+	Clocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		SmClock       string `xml:"sm_clock"`
+		MemClock      string `xml:"mem_clock"`
+		VideoClock    string `xml:"video_clock"`
+	} `xml:"clocks"`
+	// <applications_clocks>
+	// 	<graphics_clock>1190 MHz</graphics_clock>
+	// 	<mem_clock>3505 MHz</mem_clock>
+	// </applications_clocks>
+	// <default_applications_clocks>
+	// 	<graphics_clock>1190 MHz</graphics_clock>
+	// 	<mem_clock>3505 MHz</mem_clock>
+	// </default_applications_clocks>
+	MaxClocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		SmClock       string `xml:"sm_clock"`
+		MemClock      string `xml:"mem_clock"`
+		VideoClock    string `xml:"video_clock"`
+	} `xml:"max_clocks"`
+	// <max_customer_boost_clocks>
+	// 	<graphics_clock>N/A</graphics_clock>
+	// </max_customer_boost_clocks>
+	ClockPolicy struct {
+		AutoBoost        string `xml:"auto_boost"`
+		AutoBoostDefault string `xml:"auto_boost_default"`
+	} `xml:"clock_policy"`
+	// <supported_clocks>
+	//     <supported_mem_clock>
+	//         [...]
+	//     </supported_mem_clock>
+	// </supported_clocks>
+	Processes struct {
+		ProcessInfo []ProcessInfo `xml:"process_info"`
+	} `xml:"processes"`
+	// <accounted_processes>
+	// </accounted_processes>
+}
+
+type ProcessInfo struct {
+	Pid         string `xml:"pid"`
+	Type        string `xml:"type"`
+	ProcessName string `xml:"process_name"`
+	UsedMemory  string `xml:"used_memory"`
+}
+
+type ClocksThrottleReasons struct {
+	GPUIdle                   string `xml:"clocks_throttle_reason_gpu_idle"`
+	ApplicationsClocksSetting string `xml:"clocks_throttle_reason_applications_clocks_setting"`
+	SwPowerCap                string `xml:"clocks_throttle_reason_sw_power_cap"`
+	HwSlowdown                string `xml:"clocks_throttle_reason_hw_slowdown"`
+	HwThermalSlowdown         string `xml:"clocks_throttle_reason_hw_thermal_slowdown"`
+	HwPowerBrakeSlowdown      string `xml:"clocks_throttle_reason_hw_power_brake_slowdown"`
+	SyncBoost                 string `xml:"clocks_throttle_reason_sync_boost"`
+	SwThermalSlowdown         string `xml:"clocks_throttle_reason_sw_thermal_slowdown"`
+	DisplayClocksSetting      string `xml:"clocks_throttle_reason_display_clocks_setting"`
+}
+
+// ClocksEventReasons is the name of the throttle reasons since driver 535.
+type ClocksEventReasons struct {
+	GPUIdle                   string `xml:"clocks_event_reason_gpu_idle"`
+	ApplicationsClocksSetting string `xml:"clocks_event_reason_applications_clocks_setting"`
+	SwPowerCap                string `xml:"clocks_event_reason_sw_power_cap"`
+	HwSlowdown                string `xml:"clocks_event_reason_hw_slowdown"`
+	HwThermalSlowdown         string `xml:"clocks_event_reason_hw_thermal_slowdown"`
+	HwPowerBrakeSlowdown      string `xml:"clocks_event_reason_hw_power_brake_slowdown"`
+	SyncBoost                 string `xml:"clocks_event_reason_sync_boost"`
+	SwThermalSlowdown         string `xml:"clocks_event_reason_sw_thermal_slowdown"`
+	DisplayClocksSetting      string `xml:"clocks_event_reason_display_clocks_setting"`
+}
+
+// throttleReasons returns the throttle reasons of the GPU, reported as
+// clocks_event_reasons by recent drivers and clocks_throttle_reasons before.
+func (GPU GPUInfo) throttleReasons() ClocksThrottleReasons {
+	if GPU.ClocksEventReasons != (ClocksEventReasons{}) {
+		return ClocksThrottleReasons(GPU.ClocksEventReasons)
+	}
+	return GPU.ClocksThrottleReasons
+}
+
+// reasons returns the reason label and state of each throttle reason.
+func (c ClocksThrottleReasons) reasons() [][2]string {
+	return [][2]string{
+		{"gpu_idle", c.GPUIdle},
+		{"applications_clocks_setting", c.ApplicationsClocksSetting},
+		{"sw_power_cap", c.SwPowerCap},
+		{"hw_slowdown", c.HwSlowdown},
+		{"hw_thermal_slowdown", c.HwThermalSlowdown},
+		{"hw_power_brake_slowdown", c.HwPowerBrakeSlowdown},
+		{"sync_boost", c.SyncBoost},
+		{"sw_thermal_slowdown", c.SwThermalSlowdown},
+		{"display_clocks_setting", c.DisplayClocksSetting},
+	}
+}
+
+// gpuLabels returns the labels identifying a GPU, as configured by GPU_LABELS.
+func gpuLabels(id string, uuid string, name string) []label {
+	var labels []label
+	for _, l := range gpuLabelNames {
+		var value string
+		switch l.name {
+		case "id":
+			value = id
+		case "uuid":
+			value = uuid
+		case "name":
+			value = name
+		case "index":
+			if index, ok := gpuIndex(uuid); ok {
+				value = strconv.Itoa(index)
+			}
+		}
+		labels = append(labels, label{l.value, value})
+	}
+	if pods != nil {
+		labels = append(labels, pods.labels(uuid)...)
+	}
+	return labels
+}
+
+func filterVersion(value string) string {
 	r := regexp.MustCompile(`(?P<version>\d+\.\d+).*`)
 	match := r.FindStringSubmatch(value)
 	version := "0"
 	if len(match) > 0 {
 		version = match[1]
 	}
-	return formatValue(key, meta, version)
+	return version
 }
 
-func formatValue(key string, meta string, value string) string {
-	result := key
-	if meta != "" {
-		result += "{" + meta + "}"
+// labelValueEscaper escapes label values as required by the Prometheus text
+// format, so that process command lines cannot break the exposition.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(s sample) string {
+	result := s.name
+	if len(s.labels) > 0 {
+		result += "{"
+		for i, l := range s.labels {
+			if i > 0 {
+				result += ","
+			}
+			result += l.name + "=\"" + labelValueEscaper.Replace(l.value) + "\""
+		}
+		result += "}"
 	}
-	return result + " " + value + "\n"
+	return result + " " + s.value + "\n"
 }
 
 func filterUnit(s string) string {
@@ -284,7 +369,7 @@ func filterUnit(s string) string {
 	}
 
 	power := result["power"]
-	if value, err := strconv.ParseFloat(result["value"], 32); err == nil {
+	if value, err := strconv.ParseFloat(result["value"], 64); err == nil {
 		switch power {
 		case "K":
 			value *= 1000
@@ -308,6 +393,15 @@ func filterUnit(s string) string {
 	return "0"
 }
 
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func filterNumber(value string) string {
 	if value == "N/A" {
 		return "0"
@@ -316,94 +410,152 @@ func filterNumber(value string) string {
 	return r.ReplaceAllString(value, "")
 }
 
-func metrics(w http.ResponseWriter, r *http.Request) {
-	log.Print("Serving /metrics")
+func getenv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
 
-	var cmd *exec.Cmd
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// nvidiaSmiCommand returns the nvidia-smi invocation for the given arguments,
+// or a command printing the given sample file when test mode is enabled.
+func nvidiaSmiCommand(sample string, args ...string) *exec.Cmd {
 	if testMode == "1" {
 		dir, err := os.Getwd()
 		if err != nil {
 			log.Fatal(err)
 		}
-		cmd = exec.Command("/bin/cat", dir+"/nvidia-smi.sample.xml")
-	} else {
-		cmd = exec.Command(NVIDIA_SMI_PATH, "-q", "-x")
+		return exec.Command("/bin/cat", dir+"/"+sample)
 	}
+	return exec.Command(NVIDIA_SMI_PATH, args...)
+}
+
+// queryNvidiaSmi runs nvidia-smi and parses its XML report.
+func queryNvidiaSmi() (*NvidiaSmiLog, error) {
+	cmd := nvidiaSmiCommand("nvidia-smi.sample.xml", append([]string{"-q", "-x"}, gpuSelectionArgs()...)...)
 
 	// Execute system command
+	start := time.Now()
 	stdout, err := cmd.Output()
 	if err != nil {
-		println(err.Error())
-		if testMode != "1" {
-			println("Something went wrong with the execution of nvidia-smi")
-		}
-		return
+		return nil, err
 	}
+	recordCapture(stdout, start, time.Since(start))
 
 	// Parse XML
 	var xmlData NvidiaSmiLog
 	xml.Unmarshal(stdout, &xmlData)
+	filterGPUs(&xmlData)
+	return &xmlData, nil
+}
 
-	// Output
+func logQueryError(err error) {
+	println(err.Error())
+	if testMode != "1" {
+		println("Something went wrong with the execution of nvidia-smi")
+	}
+}
+
+func collectGPUs(m *metricSet, xmlData *NvidiaSmiLog) {
 	for _, GPU := range xmlData.GPU {
-		io.WriteString(w, formatVersion("nvidiasmi_driver_version", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", xmlData.DriverVersion))
-		io.WriteString(w, formatVersion("nvidiasmi_cuda_version", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", xmlData.CudaVersion))
-		io.WriteString(w, formatValue("nvidiasmi_attached_gpus", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", xmlData.AttachedGPUs))
-		io.WriteString(w, formatValue("nvidiasmi_pci_pcie_gen_max", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.PCI.GPULinkInfo.PCIeGen.Max))
-		io.WriteString(w, formatValue("nvidiasmi_pci_pcie_gen_current", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.PCI.GPULinkInfo.PCIeGen.Current))
-		io.WriteString(w, formatValue("nvidiasmi_pci_link_width_max_multiplicator", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Max)))
-		io.WriteString(w, formatValue("nvidiasmi_pci_link_width_current_multiplicator", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Current)))
-		io.WriteString(w, formatValue("nvidiasmi_pci_replay_counter", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.PCI.ReplayRolloverCounter))
-		io.WriteString(w, formatValue("nvidiasmi_pci_replay_rollover_counter", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.PCI.ReplayRolloverCounter))
-		io.WriteString(w, formatValue("nvidiasmi_pci_tx_util_bytes_per_second", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PCI.TxUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_pci_rx_util_bytes_per_second", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PCI.RxUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_fan_speed_percent", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.FanSpeed)))
-		io.WriteString(w, formatValue("nvidiasmi_performance_state_int", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterNumber(GPU.PerformanceState)))
-		io.WriteString(w, formatValue("nvidiasmi_fb_memory_usage_total_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.FbMemoryUsage.Total)))
-		io.WriteString(w, formatValue("nvidiasmi_fb_memory_usage_used_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.FbMemoryUsage.Used)))
-		io.WriteString(w, formatValue("nvidiasmi_fb_memory_usage_free_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.FbMemoryUsage.Free)))
-		io.WriteString(w, formatValue("nvidiasmi_bar1_memory_usage_total_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Bar1MemoryUsage.Total)))
-		io.WriteString(w, formatValue("nvidiasmi_bar1_memory_usage_used_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Bar1MemoryUsage.Used)))
-		io.WriteString(w, formatValue("nvidiasmi_bar1_memory_usage_free_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Bar1MemoryUsage.Free)))
-		io.WriteString(w, formatValue("nvidiasmi_utilization_gpu_percent", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Utilization.GPUUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_utilization_memory_percent", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Utilization.MemoryUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_utilization_encoder_percent", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Utilization.EncoderUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_utilization_decoder_percent", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Utilization.DecoderUtil)))
-		io.WriteString(w, formatValue("nvidiasmi_encoder_session_count", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.EncoderStats.SessionCount))
-		io.WriteString(w, formatValue("nvidiasmi_encoder_average_fps", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.EncoderStats.AverageFPS))
-		io.WriteString(w, formatValue("nvidiasmi_encoder_average_latency", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.EncoderStats.AverageLatency))
-		io.WriteString(w, formatValue("nvidiasmi_fbc_session_count", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.FBCStats.SessionCount))
-		io.WriteString(w, formatValue("nvidiasmi_fbc_average_fps", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.FBCStats.AverageFPS))
-		io.WriteString(w, formatValue("nvidiasmi_fbc_average_latency", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", GPU.FBCStats.AverageLatency))
-		io.WriteString(w, formatValue("nvidiasmi_gpu_temp_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.GPUTemp)))
-		io.WriteString(w, formatValue("nvidiasmi_gpu_temp_max_threshold_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.GPUTempMaxThreshold)))
-		io.WriteString(w, formatValue("nvidiasmi_gpu_temp_slow_threshold_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.GPUTempSlowThreshold)))
-		io.WriteString(w, formatValue("nvidiasmi_gpu_temp_max_gpu_threshold_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.GPUTempMaxGpuThreshold)))
-		io.WriteString(w, formatValue("nvidiasmi_memory_temp_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.MemoryTemp)))
-		io.WriteString(w, formatValue("nvidiasmi_gpu_temp_max_mem_threshold_celsius", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Temperature.GPUTempMaxMemThreshold)))
-		io.WriteString(w, formatValue("nvidiasmi_power_state_int", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterNumber(GPU.PowerReadings.PowerState)))
-		io.WriteString(w, formatValue("nvidiasmi_power_draw_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.PowerDraw)))
-		io.WriteString(w, formatValue("nvidiasmi_power_limit_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.PowerLimit)))
-		io.WriteString(w, formatValue("nvidiasmi_default_power_limit_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.DefaultPowerLimit)))
-		io.WriteString(w, formatValue("nvidiasmi_enforced_power_limit_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.EnforcedPowerLimit)))
-		io.WriteString(w, formatValue("nvidiasmi_min_power_limit_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.MinPowerLimit)))
-		io.WriteString(w, formatValue("nvidiasmi_max_power_limit_watts", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.PowerReadings.MaxPowerLimit)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_graphics_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Clocks.GraphicsClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_graphics_max_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.MaxClocks.GraphicsClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_sm_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Clocks.SmClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_sm_max_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.MaxClocks.SmClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_mem_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Clocks.MemClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_mem_max_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.MaxClocks.MemClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_video_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.Clocks.VideoClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_video_max_hertz", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.MaxClocks.VideoClock)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_policy_auto_boost", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.ClockPolicy.AutoBoost)))
-		io.WriteString(w, formatValue("nvidiasmi_clock_policy_auto_boost_default", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\"", filterUnit(GPU.ClockPolicy.AutoBoostDefault)))
+		meta := gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		m.add("nvidiasmi_driver_version", meta, filterVersion(xmlData.DriverVersion))
+		m.add("nvidiasmi_cuda_version", meta, filterVersion(xmlData.CudaVersion))
+		m.add("nvidiasmi_attached_gpus", meta, xmlData.AttachedGPUs)
+		m.add("nvidiasmi_pci_pcie_gen_max", meta, GPU.PCI.GPULinkInfo.PCIeGen.Max)
+		m.add("nvidiasmi_pci_pcie_gen_current", meta, GPU.PCI.GPULinkInfo.PCIeGen.Current)
+		m.add("nvidiasmi_pci_link_width_max_multiplicator", meta, filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Max))
+		m.add("nvidiasmi_pci_link_width_current_multiplicator", meta, filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Current))
+		m.add("nvidiasmi_pci_tx_util_bytes_per_second", meta, filterUnit(GPU.PCI.TxUtil))
+		m.add("nvidiasmi_pci_rx_util_bytes_per_second", meta, filterUnit(GPU.PCI.RxUtil))
+		m.add("nvidiasmi_fan_speed_percent", meta, filterUnit(GPU.FanSpeed))
+		m.add("nvidiasmi_performance_state_int", meta, filterNumber(GPU.PerformanceState))
+		m.add("nvidiasmi_fb_memory_usage_total_bytes", meta, filterUnit(GPU.FbMemoryUsage.Total))
+		m.add("nvidiasmi_fb_memory_usage_used_bytes", meta, filterUnit(GPU.FbMemoryUsage.Used))
+		m.add("nvidiasmi_fb_memory_usage_free_bytes", meta, filterUnit(GPU.FbMemoryUsage.Free))
+		m.add("nvidiasmi_bar1_memory_usage_total_bytes", meta, filterUnit(GPU.Bar1MemoryUsage.Total))
+		m.add("nvidiasmi_bar1_memory_usage_used_bytes", meta, filterUnit(GPU.Bar1MemoryUsage.Used))
+		m.add("nvidiasmi_bar1_memory_usage_free_bytes", meta, filterUnit(GPU.Bar1MemoryUsage.Free))
+		m.add("nvidiasmi_utilization_gpu_percent", meta, filterUnit(GPU.Utilization.GPUUtil))
+		m.add("nvidiasmi_utilization_memory_percent", meta, filterUnit(GPU.Utilization.MemoryUtil))
+		m.add("nvidiasmi_utilization_encoder_percent", meta, filterUnit(GPU.Utilization.EncoderUtil))
+		m.add("nvidiasmi_utilization_decoder_percent", meta, filterUnit(GPU.Utilization.DecoderUtil))
+		m.add("nvidiasmi_encoder_session_count", meta, GPU.EncoderStats.SessionCount)
+		m.add("nvidiasmi_encoder_average_fps", meta, GPU.EncoderStats.AverageFPS)
+		m.add("nvidiasmi_encoder_average_latency", meta, GPU.EncoderStats.AverageLatency)
+		m.add("nvidiasmi_fbc_session_count", meta, GPU.FBCStats.SessionCount)
+		m.add("nvidiasmi_fbc_average_fps", meta, GPU.FBCStats.AverageFPS)
+		m.add("nvidiasmi_fbc_average_latency", meta, GPU.FBCStats.AverageLatency)
+		m.add("nvidiasmi_gpu_temp_celsius", meta, filterUnit(GPU.Temperature.GPUTemp))
+		m.add("nvidiasmi_gpu_temp_max_threshold_celsius", meta, filterUnit(GPU.Temperature.GPUTempMaxThreshold))
+		m.add("nvidiasmi_gpu_temp_slow_threshold_celsius", meta, filterUnit(GPU.Temperature.GPUTempSlowThreshold))
+		m.add("nvidiasmi_gpu_temp_max_gpu_threshold_celsius", meta, filterUnit(GPU.Temperature.GPUTempMaxGpuThreshold))
+		m.add("nvidiasmi_memory_temp_celsius", meta, filterUnit(GPU.Temperature.MemoryTemp))
+		m.add("nvidiasmi_gpu_temp_max_mem_threshold_celsius", meta, filterUnit(GPU.Temperature.GPUTempMaxMemThreshold))
+		m.add("nvidiasmi_power_state_int", meta, filterNumber(GPU.PowerReadings.PowerState))
+		m.add("nvidiasmi_power_draw_watts", meta, filterUnit(GPU.PowerReadings.PowerDraw))
+		m.add("nvidiasmi_power_limit_watts", meta, filterUnit(GPU.PowerReadings.PowerLimit))
+		m.add("nvidiasmi_default_power_limit_watts", meta, filterUnit(GPU.PowerReadings.DefaultPowerLimit))
+		m.add("nvidiasmi_enforced_power_limit_watts", meta, filterUnit(GPU.PowerReadings.EnforcedPowerLimit))
+		m.add("nvidiasmi_min_power_limit_watts", meta, filterUnit(GPU.PowerReadings.MinPowerLimit))
+		m.add("nvidiasmi_max_power_limit_watts", meta, filterUnit(GPU.PowerReadings.MaxPowerLimit))
+		m.add("nvidiasmi_clock_graphics_hertz", meta, filterUnit(GPU.Clocks.GraphicsClock))
+		m.add("nvidiasmi_clock_graphics_max_hertz", meta, filterUnit(GPU.MaxClocks.GraphicsClock))
+		m.add("nvidiasmi_clock_sm_hertz", meta, filterUnit(GPU.Clocks.SmClock))
+		m.add("nvidiasmi_clock_sm_max_hertz", meta, filterUnit(GPU.MaxClocks.SmClock))
+		m.add("nvidiasmi_clock_mem_hertz", meta, filterUnit(GPU.Clocks.MemClock))
+		m.add("nvidiasmi_clock_mem_max_hertz", meta, filterUnit(GPU.MaxClocks.MemClock))
+		m.add("nvidiasmi_clock_video_hertz", meta, filterUnit(GPU.Clocks.VideoClock))
+		m.add("nvidiasmi_clock_video_max_hertz", meta, filterUnit(GPU.MaxClocks.VideoClock))
+		m.add("nvidiasmi_clock_policy_auto_boost", meta, filterUnit(GPU.ClockPolicy.AutoBoost))
+		m.add("nvidiasmi_clock_policy_auto_boost_default", meta, filterUnit(GPU.ClockPolicy.AutoBoostDefault))
+		for _, reason := range GPU.throttleReasons().reasons() {
+			if reason[1] != "N/A" && reason[1] != "" {
+				m.add("nvidiasmi_clocks_throttle_reason_active", withLabels(meta, label{"reason", reason[0]}), throttleActive(reason[1]))
+			}
+		}
+		processes := map[string]int{"C": 0, "G": 0, "C+G": 0}
+		var processMemory float64
 		for _, Process := range GPU.Processes.ProcessInfo {
-			io.WriteString(w, formatValue("nvidiasmi_process_used_memory_bytes", "id=\""+GPU.Id+"\",uuid=\""+GPU.UUID+"\",name=\""+GPU.ProductName+"\",process_name=\""+Process.ProcessName+"\",process_pid=\""+Process.Pid+"\",process_type=\""+Process.Type+"\"", filterUnit(Process.UsedMemory)))
+			processes[Process.Type]++
+			usedMemory, _ := strconv.ParseFloat(filterUnit(Process.UsedMemory), 64)
+			processMemory += usedMemory
+			if processMetricsEnabled && metricExported("nvidiasmi_process_used_memory_bytes") {
+				m.add("nvidiasmi_process_used_memory_bytes", withLabels(meta, processLabels(Process)...), filterUnit(Process.UsedMemory))
+			}
+		}
+		for _, processType := range sortedKeys(processes) {
+			m.add("nvidiasmi_processes", withLabels(meta, label{"type", processType}), strconv.Itoa(processes[processType]))
 		}
+		m.add("nvidiasmi_process_memory_bytes_sum", meta, fmt.Sprintf("%g", processMemory))
 	}
 }
 
+func metrics(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /metrics")
+
+	m, err := collect()
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+
+	writeMetricSet(w, m)
+}
+
 func index(w http.ResponseWriter, r *http.Request) {
 	log.Print("Serving /index")
 	html := `<!doctype html>
@@ -415,6 +567,8 @@ func index(w http.ResponseWriter, r *http.Request) {
     <body>
         <h1>Nvidia SMI Exporter</h1>
         <p><a href="/metrics">Metrics</a></p>
+        <p><a href="/api/v1/gpus">GPUs (JSON)</a></p>
+        <p><a href="/influx">Metrics (InfluxDB line protocol)</a></p>
     </body>
 </html>`
 	io.WriteString(w, html)
@@ -425,9 +579,177 @@ func main() {
 	if testMode == "1" {
 		log.Print("Test mode is enabled")
 	}
+	metricsInclude = compileMetricsPattern("METRICS_INCLUDE")
+	metricsExclude = compileMetricsPattern("METRICS_EXCLUDE")
+	metricsNaming = parseMetricsNaming()
+	gpuLabelNames = parseGPULabels()
+	staticLabels = parseStaticLabels()
+	registerCollector(nil, collectGPUs)
+	registerCollector(pcieFamilies, pcie.collect)
+	if os.Getenv("DMON_ENABLED") == "1" {
+		dmon = newDmonMonitor(getenvDuration("DMON_WINDOW", 15*time.Second))
+		if registerCollector(dmon.families(), dmon.collect) {
+			go dmon.run()
+			log.Print("Device monitoring is enabled")
+		}
+	}
+	if os.Getenv("NVLINK_ENABLED") == "1" {
+		registerNvlinkCollectors()
+	}
+	topologyEnabled = os.Getenv("TOPOLOGY_ENABLED") == "1"
+	if topologyEnabled {
+		registerCollector(topologyFamilies, collectTopology)
+	}
+	if os.Getenv("ENERGY_ENABLED") == "1" {
+		energy = newEnergyCounter()
+		if registerCollector(energyFamilies, energy.collect) {
+			sampleHandlers = append(sampleHandlers, energy.sample)
+			log.Print("Energy counters are enabled")
+		}
+	}
+	if os.Getenv("THROTTLE_COUNTERS_ENABLED") == "1" {
+		throttle = newThrottleCounter()
+		if registerCollector([]string{"nvidiasmi_clocks_throttle_seconds_total"}, throttle.collect) {
+			sampleHandlers = append(sampleHandlers, throttle.sample)
+			log.Print("Throttle counters are enabled")
+		}
+	}
+	if os.Getenv("XID_ENABLED") == "1" {
+		source := "/dev/kmsg"
+		if testMode == "1" {
+			source = "kmsg.sample.txt"
+		}
+		xids = newXidMonitor(getenv("XID_SOURCE", source))
+		if registerCollector(xidFamilies, xids.collect) {
+			go xids.run()
+			log.Print("Xid error counters are enabled, reading " + xids.source)
+		}
+	}
+	if os.Getenv("CONTAINER_LABELS_ENABLED") == "1" {
+		containers = newContainerResolver(getenv("PROC_ROOT", "/proc"), os.Getenv("DOCKER_SOCKET"))
+		log.Print("Container labels are enabled")
+	}
+	gpuInclude = parseGPUList(os.Getenv("GPU_INCLUDE"))
+	gpuExclude = parseGPUList(os.Getenv("GPU_EXCLUDE"))
+	processMetricsEnabled = os.Getenv("PROCESS_METRICS_ENABLED") != "0"
+	processNameBasename = os.Getenv("PROCESS_NAME_MODE") == "basename"
+	processNameProcRoot = getenv("PROC_ROOT", "/proc")
+	if pattern := os.Getenv("PROCESS_NAME_REDACT"); pattern != "" {
+		var err error
+		if processNameRedact, err = regexp.Compile(pattern); err != nil {
+			log.Fatal("Invalid PROCESS_NAME_REDACT: " + err.Error())
+		}
+	}
+	if os.Getenv("PROCESS_OWNER_ENABLED") == "1" {
+		owners = newOwnerResolver(getenv("PROC_ROOT", "/proc"))
+		log.Print("Process owner labels are enabled")
+	}
+	if os.Getenv("SLURM_ENABLED") == "1" {
+		slurm = newSlurmResolver(getenv("PROC_ROOT", "/proc"))
+		registerCollector(slurmFamilies, collectSlurmJobs)
+		log.Print("Slurm job labels are enabled")
+	}
+	if os.Getenv("KUBERNETES_ENABLED") == "1" {
+		pods = newPodResolver(getenv("POD_RESOURCES_SOCKET", "/var/lib/kubelet/pod-resources/kubelet.sock"))
+		log.Print("Kubernetes pod labels are enabled")
+	}
+	if len(sampleHandlers) > 0 {
+		go runSampler(getenvDuration("SAMPLE_INTERVAL", 5*time.Second))
+	}
+	if url := os.Getenv("REMOTE_WRITE_URL"); url != "" {
+		headers := make(http.Header)
+		for _, header := range parseLabelList("REMOTE_WRITE_HEADERS") {
+			headers.Set(header.name, header.value)
+		}
+		queueSize, err := strconv.Atoi(getenv("REMOTE_WRITE_QUEUE_SIZE", "240"))
+		if err != nil || queueSize < 1 {
+			log.Fatal("Invalid REMOTE_WRITE_QUEUE_SIZE")
+		}
+		writer := newRemoteWriter(url, headers, getenvDuration("REMOTE_WRITE_INTERVAL", 15*time.Second), queueSize)
+		go writer.run()
+		log.Print("Remote writing to " + url)
+	}
+	if endpoint := os.Getenv("OTLP_ENDPOINT"); endpoint != "" {
+		headers := make(http.Header)
+		for _, header := range parseLabelList("OTLP_HEADERS") {
+			headers.Set(header.name, header.value)
+		}
+		pusher := newOTLPPusher(endpoint, getenv("OTLP_PROTOCOL", "http/protobuf"), headers, getenvDuration("OTLP_INTERVAL", 15*time.Second))
+		go pusher.run()
+		log.Print("Exporting to OTLP endpoint " + endpoint)
+	}
+	if influxURL := os.Getenv("INFLUX_URL"); influxURL != "" {
+		pusher := newInfluxPusher(influxURL, os.Getenv("INFLUX_ORG"), os.Getenv("INFLUX_BUCKET"), os.Getenv("INFLUX_TOKEN"), getenvDuration("INFLUX_INTERVAL", 15*time.Second))
+		go pusher.run()
+		log.Print("Pushing to InfluxDB at " + influxURL)
+	}
+
+	emitterPrefix := getenv("EMITTER_PREFIX", "nvidiasmi")
+	emitterInterval := getenvDuration("EMITTER_INTERVAL", 15*time.Second)
+	if address := os.Getenv("GRAPHITE_ADDRESS"); address != "" {
+		graphite := newEmitter("Graphite", graphiteLine, getenv("GRAPHITE_PROTOCOL", "tcp"), address, emitterPrefix, os.Getenv("GRAPHITE_TAGS") == "1")
+		go graphite.run(emitterInterval)
+		log.Print("Sending to Graphite at " + address)
+	}
+	if address := os.Getenv("STATSD_ADDRESS"); address != "" {
+		statsd := newEmitter("StatsD", statsdLine, getenv("STATSD_PROTOCOL", "udp"), address, emitterPrefix, os.Getenv("STATSD_TAGS") == "1")
+		go statsd.run(emitterInterval)
+		log.Print("Sending to StatsD at " + address)
+	}
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	// The textfile command writes the metrics for the node_exporter textfile
+	// collector, once or at an interval, instead of serving them
+	if command == "textfile" {
+		directory := os.Getenv("TEXTFILE_DIRECTORY")
+		if directory == "" {
+			log.Fatal("The textfile command requires TEXTFILE_DIRECTORY")
+		}
+		interval := getenvDuration("TEXTFILE_INTERVAL", 0)
+		// Sampled counters and dmon windows start empty with the process
+		if interval == 0 && (len(sampleHandlers) > 0 || dmon != nil) {
+			log.Print("Textfile: energy, throttle time and dmon metrics accumulate while the exporter runs, and need TEXTFILE_INTERVAL")
+		}
+		runTextfile(filepath.Join(directory, TEXTFILE_NAME), interval)
+		return
+	}
+	// The push and delete commands push the metrics to the Pushgateway once,
+	// or delete them, and exit
+	if pushgatewayURL := os.Getenv("PUSHGATEWAY_URL"); pushgatewayURL != "" {
+		hostname, _ := os.Hostname()
+		pusher := newPushgateway(pushgatewayURL, getenv("PUSHGATEWAY_JOB", "nvidiasmi"), getenv("PUSHGATEWAY_INSTANCE", hostname))
+		switch command {
+		case "push":
+			if err := pusher.push(); err != nil {
+				log.Fatal("Pushgateway: " + err.Error())
+			}
+			return
+		case "delete":
+			if err := pusher.delete(); err != nil {
+				log.Fatal("Pushgateway: " + err.Error())
+			}
+			return
+		}
+		go pusher.run(getenvDuration("PUSHGATEWAY_INTERVAL", 15*time.Second), os.Getenv("PUSHGATEWAY_DELETE_ON_SHUTDOWN") == "1")
+		log.Print("Pushing to Pushgateway at " + pushgatewayURL)
+	}
+	if command != "" {
+		log.Fatal("Unknown command " + command + ", expected textfile, or push and delete with PUSHGATEWAY_URL")
+	}
 
 	log.Print("Nvidia SMI exporter listening on " + LISTEN_ADDRESS)
 	http.HandleFunc("/", index)
 	http.HandleFunc("/metrics", metrics)
+	http.HandleFunc("/influx", influx)
+	http.HandleFunc("/api/v1/gpus", gpusAPI)
+	http.HandleFunc("/api/v1/gpus/{uuid}", gpuAPI)
+	if os.Getenv("DEBUG_XML_ENABLED") == "1" {
+		http.HandleFunc("/debug/nvidia-smi.xml", debugXML)
+	}
+	if topologyEnabled {
+		http.HandleFunc("/api/topology", topologyAPI)
+	}
 	http.ListenAndServe(LISTEN_ADDRESS, nil)
 }
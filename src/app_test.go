@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A process name trying to close the label value, end the line and add a
+// series of its own
+const hostileProcessName = "/opt/evil\\\"} 1\nnvidiasmi_fake{x=\"\\\\\" --flag=\"a\\b\""
+
+// parseExpositionLine parses a sample line of the Prometheus text format,
+// unescaping its label values.
+func parseExpositionLine(line string) (string, map[string]string, float64, error) {
+	labels := make(map[string]string)
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 || !labelNameRegexp.MatchString(line[:end]) {
+		return "", nil, 0, errors.New("invalid metric name")
+	}
+	name, rest := line[:end], line[end:]
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			equal := strings.Index(rest, "=\"")
+			if equal <= 0 || !labelNameRegexp.MatchString(rest[:equal]) {
+				return "", nil, 0, errors.New("invalid label name")
+			}
+			labelName := rest[:equal]
+			rest = rest[equal+2:]
+			var value strings.Builder
+			for {
+				if rest == "" {
+					return "", nil, 0, errors.New("unterminated label value")
+				}
+				c := rest[0]
+				rest = rest[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\n' {
+					return "", nil, 0, errors.New("raw line feed in label value")
+				}
+				if c == '\\' {
+					if rest == "" {
+						return "", nil, 0, errors.New("unterminated escape")
+					}
+					switch rest[0] {
+					case '\\', '"':
+						value.WriteByte(rest[0])
+					case 'n':
+						value.WriteByte('\n')
+					default:
+						return "", nil, 0, errors.New("invalid escape")
+					}
+					rest = rest[1:]
+					continue
+				}
+				value.WriteByte(c)
+			}
+			if _, ok := labels[labelName]; ok {
+				return "", nil, 0, errors.New("duplicate label " + labelName)
+			}
+			labels[labelName] = value.String()
+			rest = strings.TrimPrefix(rest, ",")
+		}
+		rest = rest[1:]
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return "", nil, 0, errors.New("missing value")
+	}
+	value, err := strconv.ParseFloat(rest[1:], 64)
+	return name, labels, value, err
+}
+
+func TestFormatValueEscaping(t *testing.T) {
+	s := sample{"nvidiasmi_process_used_memory_bytes", []label{{"process_name", hostileProcessName}, {"process_pid", "42"}}, "1024"}
+	want := `nvidiasmi_process_used_memory_bytes{process_name="/opt/evil\\\"} 1\nnvidiasmi_fake{x=\"\\\\\" --flag=\"a\\b\"",process_pid="42"} 1024` + "\n"
+	if got := formatValue(s); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// TestScrapeHostileProcessName renders the sample report with an additional
+// hostile process and checks that every line of the scrape parses.
+func TestScrapeHostileProcessName(t *testing.T) {
+	defer func(enabled bool) { processMetricsEnabled = enabled }(processMetricsEnabled)
+	processMetricsEnabled = true
+
+	content, err := os.ReadFile("../nvidia-smi.sample.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmlData NvidiaSmiLog
+	if err := xml.Unmarshal(content, &xmlData); err != nil {
+		t.Fatal(err)
+	}
+	GPU := &xmlData.GPU[0]
+	GPU.Processes.ProcessInfo = append(GPU.Processes.ProcessInfo, ProcessInfo{Pid: "31337", Type: "C", ProcessName: hostileProcessName, UsedMemory: "1 MiB"})
+
+	m := &metricSet{}
+	collectGPUs(m, &xmlData)
+	var scrape bytes.Buffer
+	writeMetricSet(&scrape, m)
+
+	found := false
+	types := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(scrape.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 || types[fields[2]] {
+				t.Errorf("invalid or repeated type line %q", line)
+			}
+			types[fields[2]] = true
+			continue
+		}
+		name, labels, _, err := parseExpositionLine(line)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if !types[name] {
+			t.Errorf("%q: no type line for %s", line, name)
+		}
+		if name == "nvidiasmi_fake" {
+			t.Errorf("the process name injected a series: %q", line)
+		}
+		if labels["process_pid"] == "31337" {
+			found = true
+			if labels["process_name"] != hostileProcessName {
+				t.Errorf("process_name is %q, want %q", labels["process_name"], hostileProcessName)
+			}
+		}
+	}
+	if !found {
+		t.Error("the hostile process is missing from the scrape")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Naming profiles selected by METRICS_NAMING
+const (
+	NAMING_NVIDIASMI = "nvidiasmi"
+	NAMING_DCGM      = "dcgm"
+	NAMING_BOTH      = "both"
+)
+
+var metricsNaming = NAMING_NVIDIASMI
+
+type dcgmField struct {
+	name  string
+	scale float64
+}
+
+// dcgmFields maps nvidiasmi metrics to their dcgm-exporter equivalents, scaled
+// to the units DCGM reports them in.
+var dcgmFields = map[string]dcgmField{
+	"nvidiasmi_utilization_gpu_percent":              {"DCGM_FI_DEV_GPU_UTIL", 1},
+	"nvidiasmi_utilization_memory_percent":           {"DCGM_FI_DEV_MEM_COPY_UTIL", 1},
+	"nvidiasmi_utilization_encoder_percent":          {"DCGM_FI_DEV_ENC_UTIL", 1},
+	"nvidiasmi_utilization_decoder_percent":          {"DCGM_FI_DEV_DEC_UTIL", 1},
+	"nvidiasmi_fb_memory_usage_total_bytes":          {"DCGM_FI_DEV_FB_TOTAL", 1.0 / (1 << 20)},
+	"nvidiasmi_fb_memory_usage_used_bytes":           {"DCGM_FI_DEV_FB_USED", 1.0 / (1 << 20)},
+	"nvidiasmi_fb_memory_usage_free_bytes":           {"DCGM_FI_DEV_FB_FREE", 1.0 / (1 << 20)},
+	"nvidiasmi_power_draw_watts":                     {"DCGM_FI_DEV_POWER_USAGE", 1},
+	"nvidiasmi_enforced_power_limit_watts":           {"DCGM_FI_DEV_POWER_MGMT_LIMIT", 1},
+	"nvidiasmi_energy_joules_total":                  {"DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", 1000},
+	"nvidiasmi_gpu_temp_celsius":                     {"DCGM_FI_DEV_GPU_TEMP", 1},
+	"nvidiasmi_memory_temp_celsius":                  {"DCGM_FI_DEV_MEMORY_TEMP", 1},
+	"nvidiasmi_fan_speed_percent":                    {"DCGM_FI_DEV_FAN_SPEED", 1},
+	"nvidiasmi_clock_sm_hertz":                       {"DCGM_FI_DEV_SM_CLOCK", 1e-6},
+	"nvidiasmi_clock_mem_hertz":                      {"DCGM_FI_DEV_MEM_CLOCK", 1e-6},
+	"nvidiasmi_clock_video_hertz":                    {"DCGM_FI_DEV_VIDEO_CLOCK", 1e-6},
+	"nvidiasmi_performance_state_int":                {"DCGM_FI_DEV_PSTATE", 1},
+	"nvidiasmi_pci_replay_counter":                   {"DCGM_FI_DEV_PCIE_REPLAY_COUNTER", 1},
+	"nvidiasmi_pci_pcie_gen_current":                 {"DCGM_FI_DEV_PCIE_LINK_GEN", 1},
+	"nvidiasmi_pci_link_width_current_multiplicator": {"DCGM_FI_DEV_PCIE_LINK_WIDTH", 1},
+	"nvidiasmi_pci_tx_util_bytes_per_second":         {"DCGM_FI_DEV_PCIE_TX_THROUGHPUT", 1.0 / 1024},
+	"nvidiasmi_pci_rx_util_bytes_per_second":         {"DCGM_FI_DEV_PCIE_RX_THROUGHPUT", 1.0 / 1024},
+}
+
+// dcgmGPULabels are the identity labels used by dcgm-exporter.
+var dcgmGPULabels = []label{{"index", "gpu"}, {"uuid", "UUID"}, {"id", "pci_bus_id"}, {"name", "modelName"}}
+
+func parseMetricsNaming() string {
+	naming := getenv("METRICS_NAMING", NAMING_NVIDIASMI)
+	switch naming {
+	case NAMING_NVIDIASMI, NAMING_DCGM, NAMING_BOTH:
+	default:
+		log.Fatal("Invalid METRICS_NAMING: " + naming)
+	}
+	return naming
+}
+
+// exportedNames returns the names a metric is exported as under the naming
+// profile, leaving out the filtered ones.
+func exportedNames(name string) []string {
+	var names []string
+	if metricsNaming != NAMING_DCGM && metricEnabled(name) {
+		names = append(names, name)
+	}
+	if field, ok := dcgmFields[name]; ok && metricsNaming != NAMING_NVIDIASMI && metricEnabled(field.name) {
+		names = append(names, field.name)
+	}
+	return names
+}
+
+func metricExported(name string) bool {
+	return len(exportedNames(name)) > 0
+}
+
+// dcgmValue converts a value to the unit of its dcgm-exporter equivalent.
+func dcgmValue(name string, value string) string {
+	field := dcgmFields[name]
+	if field.scale == 1 {
+		return value
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return fmt.Sprintf("%g", number*field.scale)
+}
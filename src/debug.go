@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lastCapture holds the last XML report output by nvidia-smi, as is.
+var lastCapture struct {
+	sync.Mutex
+	xml      []byte
+	time     time.Time
+	duration time.Duration
+}
+
+func recordCapture(xml []byte, start time.Time, duration time.Duration) {
+	lastCapture.Lock()
+	defer lastCapture.Unlock()
+	lastCapture.xml = xml
+	lastCapture.time = start
+	lastCapture.duration = duration
+}
+
+func debugXML(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /debug/nvidia-smi.xml")
+
+	lastCapture.Lock()
+	captured := lastCapture.xml != nil
+	lastCapture.Unlock()
+	if !captured {
+		if _, err := queryNvidiaSmi(); err != nil {
+			logQueryError(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	lastCapture.Lock()
+	defer lastCapture.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Capture-Time", lastCapture.time.UTC().Format(time.RFC3339Nano))
+	w.Header().Set("X-Command-Duration", fmt.Sprintf("%.3f", lastCapture.duration.Seconds()))
+	w.Write(lastCapture.xml)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DMON_METRICS = "pucvmet"
+const DMON_RESTART_DELAY = 5 * time.Second
+
+var dmon *dmonMonitor
+
+type dmonField struct {
+	column string
+	name   string
+	unit   string
+	scale  float64
+}
+
+// Columns reported by `nvidia-smi dmon -s pucvmet`, in output order.
+var dmonFields = []dmonField{
+	{"pwr", "power_draw", "watts", 1},
+	{"gtemp", "gpu_temp", "celsius", 1},
+	{"mtemp", "memory_temp", "celsius", 1},
+	{"sm", "utilization_sm", "percent", 1},
+	{"mem", "utilization_memory", "percent", 1},
+	{"enc", "utilization_encoder", "percent", 1},
+	{"dec", "utilization_decoder", "percent", 1},
+	{"mclk", "clock_mem", "hertz", 1000 * 1000},
+	{"pclk", "clock_graphics", "hertz", 1000 * 1000},
+	{"pviol", "power_violation", "percent", 1},
+	{"tviol", "thermal_violation", "", 1},
+	{"fb", "fb_memory_used", "bytes", 1024 * 1024},
+	{"bar1", "bar1_memory_used", "bytes", 1024 * 1024},
+	{"sbecc", "ecc_single_bit_errors", "", 1},
+	{"dbecc", "ecc_double_bit_errors", "", 1},
+	{"pci", "pci_replay_errors", "", 1},
+	{"rxpci", "pci_rx", "bytes_per_second", 1000 * 1000},
+	{"txpci", "pci_tx", "bytes_per_second", 1000 * 1000},
+}
+
+type dmonSample struct {
+	time   time.Time
+	values map[string]float64
+}
+
+// dmonMonitor keeps the samples streamed by nvidia-smi dmon over a rolling
+// window, so that spikes shorter than the scrape interval are still visible.
+type dmonMonitor struct {
+	window  time.Duration
+	mu      sync.Mutex
+	samples map[int][]dmonSample
+}
+
+func newDmonMonitor(window time.Duration) *dmonMonitor {
+	return &dmonMonitor{
+		window:  window,
+		samples: make(map[int][]dmonSample),
+	}
+}
+
+func (m *dmonMonitor) run() {
+	for {
+		cmd := nvidiaSmiCommand("nvidia-smi-dmon.sample.txt", "dmon", "-s", DMON_METRICS, "-d", "1")
+		if err := m.stream(cmd); err != nil {
+			log.Print("nvidia-smi dmon: " + err.Error())
+		}
+		time.Sleep(DMON_RESTART_DELAY)
+	}
+}
+
+func (m *dmonMonitor) stream(cmd *exec.Cmd) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var columns []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			// The first header line names the columns, the second one holds units
+			fields := strings.Fields(strings.TrimPrefix(line, "#"))
+			if len(fields) > 0 && fields[0] == "gpu" {
+				columns = fields
+			}
+			continue
+		}
+		if columns != nil {
+			m.add(time.Now(), columns, strings.Fields(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+func (m *dmonMonitor) add(now time.Time, columns []string, fields []string) {
+	index := -1
+	values := make(map[string]float64)
+	for i, column := range columns {
+		if i >= len(fields) {
+			break
+		}
+		if column == "gpu" {
+			if value, err := strconv.Atoi(fields[i]); err == nil {
+				index = value
+			}
+			continue
+		}
+		// Unsupported readings are reported as "-"
+		if value, err := strconv.ParseFloat(fields[i], 64); err == nil {
+			values[column] = value
+		}
+	}
+	if index < 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[index] = append(m.samples[index], dmonSample{now, values})
+	m.prune(now)
+}
+
+func (m *dmonMonitor) prune(now time.Time) {
+	for index, samples := range m.samples {
+		i := 0
+		for i < len(samples) && now.Sub(samples[i].time) > m.window {
+			i++
+		}
+		if i == len(samples) {
+			delete(m.samples, index)
+		} else {
+			m.samples[index] = samples[i:]
+		}
+	}
+}
+
+func dmonMetricName(field dmonField, stat string) string {
+	name := "nvidiasmi_dmon_" + field.name + "_" + stat
+	if field.unit != "" {
+		name += "_" + field.unit
+	}
+	return name
+}
+
+func (d *dmonMonitor) families() []string {
+	families := []string{"nvidiasmi_dmon_samples"}
+	for _, field := range dmonFields {
+		for _, stat := range []string{"min", "max", "avg"} {
+			families = append(families, dmonMetricName(field, stat))
+		}
+	}
+	return families
+}
+
+// collect outputs the min, max and average of every dmon reading over the
+// window.
+func (d *dmonMonitor) collect(m *metricSet, xmlData *NvidiaSmiLog) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+
+	for _, GPU := range xmlData.GPU {
+		index, ok := gpuIndex(GPU.UUID)
+		samples := d.samples[index]
+		if !ok || len(samples) == 0 {
+			continue
+		}
+		meta := gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		m.add("nvidiasmi_dmon_samples", meta, strconv.Itoa(len(samples)))
+		for _, field := range dmonFields {
+			var min, max, sum float64
+			count := 0
+			for _, sample := range samples {
+				value, ok := sample.values[field.column]
+				if !ok {
+					continue
+				}
+				if count == 0 || value < min {
+					min = value
+				}
+				if count == 0 || value > max {
+					max = value
+				}
+				sum += value
+				count++
+			}
+			if count == 0 {
+				continue
+			}
+			m.add(dmonMetricName(field, "min"), meta, fmt.Sprintf("%g", min*field.scale))
+			m.add(dmonMetricName(field, "max"), meta, fmt.Sprintf("%g", max*field.scale))
+			m.add(dmonMetricName(field, "avg"), meta, fmt.Sprintf("%g", sum/float64(count)*field.scale))
+		}
+	}
+}
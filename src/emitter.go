@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EMITTER_TIMEOUT = 10 * time.Second
+
+// Keep UDP datagrams below the usual MTU
+const EMITTER_MAX_DATAGRAM = 1400
+
+var pathSegmentRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+var graphiteTagNameRegexp = regexp.MustCompile(`[;~!^=\s]`)
+var graphiteTagValueRegexp = regexp.MustCompile(`[;~\s]`)
+var dogstatsdTagNameRegexp = regexp.MustCompile(`[,|#:\s]`)
+var dogstatsdTagValueRegexp = regexp.MustCompile(`[,|#\s]`)
+
+// Labels describing the GPU rather than the series, left out of plain paths
+var gpuAttributeLabels = map[string]bool{"namespace": true, "pod": true, "container": true}
+
+// emitter periodically sends every reading as <prefix>.<host>.<gpu>.<metric>
+// to Graphite or StatsD.
+type emitter struct {
+	name     string
+	protocol string
+	address  string
+	prefix   string
+	tags     bool
+	format   func(path string, tags []label, value string, now time.Time) string
+}
+
+// graphiteLine formats a Graphite plaintext line, with tags when enabled.
+func graphiteLine(path string, tags []label, value string, now time.Time) string {
+	for _, tag := range tags {
+		path += ";" + graphiteTagNameRegexp.ReplaceAllString(tag.name, "_") + "=" + graphiteTagValueRegexp.ReplaceAllString(tag.value, "_")
+	}
+	return path + " " + value + " " + strconv.FormatInt(now.Unix(), 10) + "\n"
+}
+
+// statsdLine formats a StatsD gauge, with DogStatsD tags when enabled.
+func statsdLine(path string, tags []label, value string, now time.Time) string {
+	line := path + ":" + value + "|g"
+	for i, tag := range tags {
+		if i == 0 {
+			line += "|#"
+		} else {
+			line += ","
+		}
+		line += dogstatsdTagNameRegexp.ReplaceAllString(tag.name, "_") + ":" + dogstatsdTagValueRegexp.ReplaceAllString(tag.value, "_")
+	}
+	return line + "\n"
+}
+
+func newEmitter(name string, format func(path string, tags []label, value string, now time.Time) string, protocol string, address string, prefix string, tags bool) *emitter {
+	if protocol != "tcp" && protocol != "udp" {
+		log.Fatal("Invalid " + strings.ToUpper(name) + "_PROTOCOL: " + protocol)
+	}
+	// The prefix may have several segments
+	segments := strings.Split(prefix, ".")
+	for i, segment := range segments {
+		segments[i] = pathSegment(segment)
+	}
+	return &emitter{name: name, protocol: protocol, address: address, prefix: strings.Join(segments, "."), tags: tags, format: format}
+}
+
+// pathSegment makes a label value a single path segment, replacing the
+// characters other than letters, digits, "_" and "-", such as the "." path
+// separator, spaces or the ":" and "|" of StatsD, with "_".
+func pathSegment(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return pathSegmentRegexp.ReplaceAllString(value, "_")
+}
+
+// lines formats the samples. The GPU segment is the nvidia-smi index; series
+// without GPU, such as Slurm jobs, have none. Without tags, the values of the
+// labels distinguishing the series of a metric are appended to the path.
+func (e *emitter) lines(m *metricSet, now time.Time) []string {
+	hostname, _ := os.Hostname()
+	uuidLabel := ""
+	identity := make(map[string]bool)
+	for _, l := range gpuLabelNames {
+		identity[l.value] = true
+		if l.name == "uuid" {
+			uuidLabel = l.value
+		}
+	}
+	for _, l := range staticLabels {
+		identity[l.name] = true
+	}
+
+	var lines []string
+	for _, s := range m.samples {
+		if _, err := strconv.ParseFloat(s.value, 64); err != nil {
+			continue
+		}
+		path := e.prefix + "." + pathSegment(hostname)
+		for _, l := range s.labels {
+			if l.name != uuidLabel {
+				continue
+			}
+			if index, ok := gpuIndex(l.value); ok {
+				path += "." + strconv.Itoa(index)
+			} else {
+				path += "." + pathSegment(l.value)
+			}
+		}
+		path += "." + pathSegment(strings.TrimPrefix(s.name, "nvidiasmi_"))
+
+		var tags []label
+		if e.tags {
+			// Neither format allows empty tag values
+			for _, l := range s.labels {
+				if l.value != "" {
+					tags = append(tags, l)
+				}
+			}
+		} else {
+			for _, l := range s.labels {
+				if !identity[l.name] && !gpuAttributeLabels[l.name] {
+					path += "." + pathSegment(l.value)
+				}
+			}
+		}
+		lines = append(lines, e.format(path, tags, s.value, now))
+	}
+	return lines
+}
+
+// send writes the lines over TCP, or in datagrams of several lines over UDP.
+func (e *emitter) send(lines []string) error {
+	conn, err := net.DialTimeout(e.protocol, e.address, EMITTER_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(EMITTER_TIMEOUT))
+
+	var buffer string
+	for _, line := range lines {
+		if e.protocol == "udp" && buffer != "" && len(buffer)+len(line) > EMITTER_MAX_DATAGRAM {
+			if _, err := conn.Write([]byte(buffer)); err != nil {
+				return err
+			}
+			buffer = ""
+		}
+		buffer += line
+	}
+	if buffer != "" {
+		_, err = conn.Write([]byte(buffer))
+	}
+	return err
+}
+
+func (e *emitter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m, err := collect()
+		if err == nil {
+			err = e.send(e.lines(m, time.Now()))
+		}
+		if err != nil {
+			log.Print(e.name + ": " + err.Error())
+		}
+	}
+}
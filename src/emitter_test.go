@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEmitterUUID = "GPU-cf5ce50c-9d96-5da7-adb6-b662d5afe4bc"
+
+func emitterTestMetricSet() *metricSet {
+	m := &metricSet{}
+	gpu := []label{{"id", "00000000:01:00.0"}, {"uuid", testEmitterUUID}, {"name", "GeForce GTX 980"}}
+	m.add("nvidiasmi_power_draw_watts", gpu, "45.45")
+	m.add("nvidiasmi_clocks_throttle_reason_active", withLabels(gpu, label{"reason", "sw_power_cap"}), "1")
+	m.add("nvidiasmi_process_used_memory_bytes", withLabels(gpu, label{"process_name", "/usr/bin/python3.11 train.py|x:1"}, label{"process_pid", "42"}, label{"process_type", "C"}, label{"container_name", ""}), "1024")
+	m.add("nvidiasmi_slurm_job_gpus", []label{{"slurm_job_id", "7"}}, "1")
+	m.add("nvidiasmi_clocks_throttle_reason_active", gpu, "N/A")
+	return m
+}
+
+// emitterTestHost is the host segment of the paths.
+func emitterTestHost(t *testing.T) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pathSegment(hostname)
+}
+
+func TestEmitterLines(t *testing.T) {
+	defer func(mode string) { testMode = mode }(testMode)
+	testMode = "1"
+	t.Chdir("..")
+
+	now := time.Unix(1700000000, 0)
+	host := "my_prefix.gpus." + emitterTestHost(t)
+	e := newEmitter("Graphite", graphiteLine, "tcp", "localhost:2003", "my prefix.gpus", false)
+	// Process names are a single path segment
+	want := []string{
+		host + ".0.power_draw_watts 45.45 1700000000\n",
+		host + ".0.clocks_throttle_reason_active.sw_power_cap 1 1700000000\n",
+		host + ".0.process_used_memory_bytes._usr_bin_python3_11_train_py_x_1.42.C._ 1024 1700000000\n",
+		host + ".slurm_job_gpus.7 1 1700000000\n",
+	}
+	if got := e.lines(emitterTestMetricSet(), now); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, ""), strings.Join(want, ""))
+	}
+
+	host = "nvidiasmi." + emitterTestHost(t)
+	e = newEmitter("Graphite", graphiteLine, "tcp", "localhost:2003", "nvidiasmi", true)
+	lines := e.lines(emitterTestMetricSet(), now)
+	if want := host + ".0.process_used_memory_bytes;id=00000000:01:00.0;uuid=" + testEmitterUUID + ";name=GeForce_GTX_980;process_name=/usr/bin/python3.11_train.py|x:1;process_pid=42;process_type=C 1024 1700000000\n"; lines[2] != want {
+		t.Errorf("got %q, want %q", lines[2], want)
+	}
+
+	e = newEmitter("StatsD", statsdLine, "udp", "localhost:8125", "nvidiasmi", true)
+	lines = e.lines(emitterTestMetricSet(), now)
+	if want := host + ".0.process_used_memory_bytes:1024|g|#id:00000000:01:00.0,uuid:" + testEmitterUUID + ",name:GeForce_GTX_980,process_name:/usr/bin/python3.11_train.py_x:1,process_pid:42,process_type:C\n"; lines[2] != want {
+		t.Errorf("got %q, want %q", lines[2], want)
+	}
+	e = newEmitter("StatsD", statsdLine, "udp", "localhost:8125", "nvidiasmi", false)
+	if got, want := e.lines(emitterTestMetricSet(), now)[0], host+".0.power_draw_watts:45.45|g\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEmitterSendTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	e := newEmitter("Graphite", graphiteLine, "tcp", listener.Addr().String(), "nvidiasmi", false)
+	if err := e.send([]string{"a.b 1 1700000000\n", "a.c 2 1700000000\n"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lines := <-received:
+		if !reflect.DeepEqual(lines, []string{"a.b 1 1700000000", "a.c 2 1700000000"}) {
+			t.Errorf("got %q", lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestEmitterSendUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 30 lines of 100 bytes fit in 3 datagrams
+	line := strings.Repeat("a", 95) + ":1|g\n"
+	lines := make([]string, 30)
+	for i := range lines {
+		lines[i] = line
+	}
+	e := newEmitter("StatsD", statsdLine, "udp", conn.LocalAddr().String(), "nvidiasmi", false)
+	if err := e.send(lines); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 65536)
+	for _, want := range []int{14, 14, 2} {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > EMITTER_MAX_DATAGRAM || n != want*len(line) {
+			t.Errorf("got a datagram of %d bytes, want %d lines", n, want)
+		}
+	}
+}
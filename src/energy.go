@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var energy *energyCounter
+
+var energyFamilies = []string{"nvidiasmi_energy_joules_total", "nvidiasmi_process_energy_joules_total"}
+
+type energyProcess struct {
+	labels []label
+	joules float64
+}
+
+// energyCounter accumulates the energy used by each GPU between samples,
+// and apportions it to the processes running on the GPU.
+type energyCounter struct {
+	mu          sync.Mutex
+	lastTime    map[string]time.Time
+	lastPower   map[string]float64
+	lastCounter map[string]float64
+	labels      map[string][]label
+	joules      map[string]float64
+	processes   map[string]map[string]*energyProcess
+}
+
+func newEnergyCounter() *energyCounter {
+	return &energyCounter{
+		lastTime:    make(map[string]time.Time),
+		lastPower:   make(map[string]float64),
+		lastCounter: make(map[string]float64),
+		labels:      make(map[string][]label),
+		joules:      make(map[string]float64),
+		processes:   make(map[string]map[string]*energyProcess),
+	}
+}
+
+// parseSmiTable reads the column based output of commands such as
+// `nvidia-smi pmon`, keyed by the names of the first header line.
+func parseSmiTable(output []byte) []map[string]string {
+	var rows []map[string]string
+	var columns []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			if columns == nil {
+				columns = strings.Fields(strings.TrimPrefix(line, "#"))
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if columns == nil || len(fields) == 0 {
+			continue
+		}
+		row := make(map[string]string)
+		for i, column := range columns {
+			if i < len(fields) {
+				row[column] = fields[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// queryEnergyConsumption returns the driver energy counters in joules by GPU
+// UUID, for the GPUs supporting them (Volta and newer).
+func queryEnergyConsumption() map[string]float64 {
+	counters := make(map[string]float64)
+	stdout, err := nvidiaSmiCommand("nvidia-smi-energy.sample.csv", "--query-gpu=uuid,total_energy_consumption", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		log.Print("nvidia-smi total_energy_consumption: " + err.Error())
+		return counters
+	}
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		// Reported in millijoules, or as [N/A] or [Not Supported]
+		if value, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err == nil {
+			counters[strings.TrimSpace(fields[0])] = value / 1000
+		}
+	}
+	return counters
+}
+
+// queryProcessUtilization returns the SM utilization of each process, keyed
+// by GPU index and PID.
+func queryProcessUtilization() map[string]float64 {
+	utilization := make(map[string]float64)
+	stdout, err := nvidiaSmiCommand("nvidia-smi-pmon.sample.txt", "pmon", "-c", "1", "-s", "u").Output()
+	if err != nil {
+		log.Print("nvidia-smi pmon: " + err.Error())
+		return utilization
+	}
+	for _, row := range parseSmiTable(stdout) {
+		if value, err := strconv.ParseFloat(row["sm"], 64); err == nil {
+			utilization[row["gpu"]+"/"+row["pid"]] = value
+		}
+	}
+	return utilization
+}
+
+func (e *energyCounter) sample(now time.Time, xmlData *NvidiaSmiLog) {
+	e.account(now, xmlData, queryEnergyConsumption(), queryProcessUtilization())
+}
+
+// account accumulates the energy used since the previous sample, given the
+// driver energy counters and the SM utilization of the processes.
+func (e *energyCounter) account(now time.Time, xmlData *NvidiaSmiLog, counters map[string]float64, utilization map[string]float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, GPU := range xmlData.GPU {
+		labels := gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		e.labels[GPU.UUID] = labels
+
+		// Prefer the driver counter, and fall back on integrating the power
+		// draw. After a failed read or a reset, the interval is integrated and
+		// the counter taken as a new baseline, so that no interval is counted
+		// twice.
+		var joules float64
+		power, _ := strconv.ParseFloat(filterUnit(GPU.PowerReadings.PowerDraw), 64)
+		counter, hasCounter := counters[GPU.UUID]
+		if last, ok := e.lastTime[GPU.UUID]; ok {
+			if previous, ok := e.lastCounter[GPU.UUID]; ok && hasCounter && counter >= previous {
+				joules = counter - previous
+			} else {
+				joules = (e.lastPower[GPU.UUID] + power) / 2 * now.Sub(last).Seconds()
+			}
+		}
+		e.lastTime[GPU.UUID] = now
+		e.lastPower[GPU.UUID] = power
+		if hasCounter {
+			e.lastCounter[GPU.UUID] = counter
+		} else {
+			delete(e.lastCounter, GPU.UUID)
+		}
+		e.joules[GPU.UUID] += joules
+
+		// Apportion by SM utilization share, or by memory share when idle
+		weights := make(map[string]float64)
+		var total float64
+		index, _ := gpuIndex(GPU.UUID)
+		for _, Process := range GPU.Processes.ProcessInfo {
+			weights[Process.Pid] = utilization[strconv.Itoa(index)+"/"+Process.Pid]
+			total += weights[Process.Pid]
+		}
+		if total == 0 {
+			for _, Process := range GPU.Processes.ProcessInfo {
+				weights[Process.Pid], _ = strconv.ParseFloat(filterUnit(Process.UsedMemory), 64)
+				total += weights[Process.Pid]
+			}
+		}
+
+		// Processes which left the GPU are forgotten
+		processes := make(map[string]*energyProcess)
+		for _, Process := range GPU.Processes.ProcessInfo {
+			key := Process.Pid + "/" + Process.ProcessName
+			process, ok := e.processes[GPU.UUID][key]
+			if !ok {
+				process = &energyProcess{labels: withLabels(labels, processLabels(Process)...)}
+			}
+			if total > 0 {
+				process.joules += joules * weights[Process.Pid] / total
+			}
+			processes[key] = process
+		}
+		e.processes[GPU.UUID] = processes
+	}
+}
+
+func (e *energyCounter) collect(m *metricSet, xmlData *NvidiaSmiLog) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, uuid := range sortedKeys(e.labels) {
+		m.add("nvidiasmi_energy_joules_total", e.labels[uuid], fmt.Sprintf("%g", e.joules[uuid]))
+	}
+	if !processMetricsEnabled {
+		return
+	}
+	for _, uuid := range sortedKeys(e.labels) {
+		for _, key := range sortedKeys(e.processes[uuid]) {
+			process := e.processes[uuid][key]
+			m.add("nvidiasmi_process_energy_joules_total", process.labels, fmt.Sprintf("%g", process.joules))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnergyCounter(t *testing.T) {
+	defer func(mode string) { testMode = mode }(testMode)
+	testMode = "1"
+	t.Chdir("..")
+
+	xmlData := readSampleXML(t, "nvidia-smi.sample.xml")
+	uuid := xmlData.GPU[0].UUID
+	// The sample GPU draws 45.45 W, that is 454.5 J over 10s
+	tests := []struct {
+		counters map[string]float64
+		joules   float64
+	}{
+		{map[string]float64{uuid: 1000}, 0},
+		{map[string]float64{uuid: 1500}, 500},
+		// A failed read, which the next counter delta must not cover again
+		{map[string]float64{}, 954.5},
+		{map[string]float64{uuid: 2500}, 1409},
+		{map[string]float64{uuid: 2600}, 1509},
+		// A reset of the counter
+		{map[string]float64{uuid: 50}, 1963.5},
+		{map[string]float64{uuid: 150}, 2063.5},
+	}
+	e := newEnergyCounter()
+	start := time.Unix(1700000000, 0)
+	for i, test := range tests {
+		e.account(start.Add(time.Duration(i)*10*time.Second), xmlData, test.counters, map[string]float64{})
+		if got := e.joules[uuid]; got < test.joules-1e-9 || got > test.joules+1e-9 {
+			t.Errorf("sample %d: got %g J, want %g J", i, got, test.joules)
+		}
+	}
+
+	// The energy is apportioned by memory share when the processes are idle
+	var processes float64
+	for _, process := range e.processes[uuid] {
+		processes += process.joules
+	}
+	if processes < 2063.5-1e-9 || processes > 2063.5+1e-9 {
+		t.Errorf("processes used %g J, want 2063.5 J", processes)
+	}
+}
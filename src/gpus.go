@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gpuInclude []string
+var gpuExclude []string
+
+// nvidia-smi numbers GPUs by index in its table outputs (dmon, pmon, topo),
+// which neither matches the minor number nor survives GPU selection.
+var gpuIndexCache struct {
+	sync.Mutex
+	indexes map[string]int
+}
+
+// parseGPUList splits a comma separated list of minor numbers, UUIDs and PCI
+// bus IDs.
+func parseGPUList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// normalizePCIBusId formats a PCI bus ID such as 0000:01:00.0 or 01:00.0
+// the way nvidia-smi reports it in the XML, 00000000:01:00.0.
+func normalizePCIBusId(id string) string {
+	var domain, bus, device, function uint64
+	parts := strings.Split(strings.ToLower(id), ":")
+	if len(parts) == 3 {
+		domain, _ = strconv.ParseUint(parts[0], 16, 32)
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return id
+	}
+	bus, _ = strconv.ParseUint(parts[0], 16, 8)
+	deviceFunction := strings.SplitN(parts[1], ".", 2)
+	device, _ = strconv.ParseUint(deviceFunction[0], 16, 8)
+	if len(deviceFunction) == 2 {
+		function, _ = strconv.ParseUint(deviceFunction[1], 16, 8)
+	}
+	return fmt.Sprintf("%08X:%02X:%02X.%X", domain, bus, device, function)
+}
+
+func isMinorNumber(entry string) bool {
+	_, err := strconv.Atoi(entry)
+	return err == nil
+}
+
+func gpuMatches(entries []string, GPU *GPUInfo) bool {
+	for _, entry := range entries {
+		switch {
+		case isMinorNumber(entry):
+			if entry == GPU.MinorNumber {
+				return true
+			}
+		case strings.Contains(entry, ":"):
+			if normalizePCIBusId(entry) == normalizePCIBusId(GPU.Id) {
+				return true
+			}
+		case strings.EqualFold(entry, GPU.UUID):
+			return true
+		}
+	}
+	return false
+}
+
+// gpuSelected tells whether a GPU passes the GPU_INCLUDE and GPU_EXCLUDE lists.
+func gpuSelected(GPU *GPUInfo) bool {
+	if len(gpuInclude) > 0 && !gpuMatches(gpuInclude, GPU) {
+		return false
+	}
+	return !gpuMatches(gpuExclude, GPU)
+}
+
+func filterGPUs(xmlData *NvidiaSmiLog) {
+	gpus := xmlData.GPU[:0]
+	for i := range xmlData.GPU {
+		if gpuSelected(&xmlData.GPU[i]) {
+			gpus = append(gpus, xmlData.GPU[i])
+		}
+	}
+	xmlData.GPU = gpus
+}
+
+// gpuSelectionArgs returns the nvidia-smi -i option limiting the query to the
+// included GPUs. nvidia-smi takes indexes rather than minor numbers, so lists
+// including minor numbers are only applied after the query.
+func gpuSelectionArgs() []string {
+	if len(gpuInclude) == 0 {
+		return nil
+	}
+	for _, entry := range gpuInclude {
+		if isMinorNumber(entry) {
+			return nil
+		}
+	}
+	return []string{"-i", strings.Join(gpuInclude, ",")}
+}
+
+// gpuIndex returns the nvidia-smi index of a GPU.
+func gpuIndex(uuid string) (int, bool) {
+	gpuIndexCache.Lock()
+	defer gpuIndexCache.Unlock()
+	if gpuIndexCache.indexes == nil {
+		stdout, err := nvidiaSmiCommand("nvidia-smi-index.sample.csv", "--query-gpu=index,uuid", "--format=csv,noheader").Output()
+		if err != nil {
+			log.Print("nvidia-smi index: " + err.Error())
+			return 0, false
+		}
+		gpuIndexCache.indexes = make(map[string]int)
+		for _, line := range strings.Split(string(stdout), "\n") {
+			fields := strings.Split(line, ",")
+			if len(fields) != 2 {
+				continue
+			}
+			if index, err := strconv.Atoi(strings.TrimSpace(fields[0])); err == nil {
+				gpuIndexCache.indexes[strings.TrimSpace(fields[1])] = index
+			}
+		}
+	}
+	index, ok := gpuIndexCache.indexes[uuid]
+	return index, ok
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newGRPCClient returns an HTTP client speaking cleartext HTTP/2 to the given
+// address, such as a unix socket of a local gRPC service.
+func newGRPCClient(network string, address string, timeout time.Duration) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// grpcInvoke performs a unary gRPC call of the given method, such as
+// /v1.PodResourcesLister/List, with optional metadata and an encoded protobuf
+// request.
+func grpcInvoke(client *http.Client, method string, metadata http.Header, request []byte) ([]byte, error) {
+	body := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	body = append(body, request...)
+
+	httpRequest, err := http.NewRequest("POST", "http://localhost"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range metadata {
+		httpRequest.Header[key] = values
+	}
+	httpRequest.Header.Set("Content-Type", "application/grpc")
+	httpRequest.Header.Set("TE", "trailers")
+
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("gRPC " + method + ": " + response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors without a message are reported in the headers instead of the trailers
+	status := response.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = response.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return nil, errors.New("gRPC " + method + ": status " + status + " " + response.Trailer.Get("Grpc-Message") + response.Header.Get("Grpc-Message"))
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("gRPC " + method + ": truncated response")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("gRPC " + method + ": compressed responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < length {
+		return nil, errors.New("gRPC " + method + ": truncated response")
+	}
+	return data[5 : 5+length], nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const INFLUX_TIMEOUT = 10 * time.Second
+
+var influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+
+// Backslashes are escaped too, so that a value ending with one, such as a
+// Windows path, does not escape the comma or space following it.
+var influxTagEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+
+// writeInflux writes the samples in the InfluxDB line protocol, one point per
+// sample with its labels as tags and a single value field.
+func writeInflux(w io.Writer, m *metricSet, now time.Time) {
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	for _, s := range m.samples {
+		value, err := strconv.ParseFloat(s.value, 64)
+		if err != nil {
+			continue
+		}
+		line := influxMeasurementEscaper.Replace(s.name)
+		for _, l := range s.labels {
+			// Empty tag values are not allowed
+			if l.value != "" {
+				line += "," + influxTagEscaper.Replace(l.name) + "=" + influxTagEscaper.Replace(l.value)
+			}
+		}
+		io.WriteString(w, line+" value="+strconv.FormatFloat(value, 'g', -1, 64)+" "+timestamp+"\n")
+	}
+}
+
+func influx(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /influx")
+
+	m, err := collect()
+	if err != nil {
+		logQueryError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeInflux(w, m, time.Now())
+}
+
+// influxPusher writes the metrics to the InfluxDB v2 HTTP write API.
+type influxPusher struct {
+	client   *http.Client
+	url      string
+	token    string
+	interval time.Duration
+}
+
+func newInfluxPusher(baseURL string, org string, bucket string, token string, interval time.Duration) *influxPusher {
+	query := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ns"}}
+	return &influxPusher{
+		client:   &http.Client{Timeout: INFLUX_TIMEOUT},
+		url:      strings.TrimSuffix(baseURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:    token,
+		interval: interval,
+	}
+}
+
+func (p *influxPusher) run() {
+	for range time.Tick(p.interval) {
+		if err := p.push(); err != nil {
+			log.Print("InfluxDB push: " + err.Error())
+		}
+	}
+}
+
+func (p *influxPusher) push() error {
+	m, err := collect()
+	if err != nil {
+		return err
+	}
+	return p.write(m, time.Now())
+}
+
+// write sends the samples to the write API.
+func (p *influxPusher) write(m *metricSet, now time.Time) error {
+	var body bytes.Buffer
+	writeInflux(&body, m, now)
+
+	request, err := http.NewRequest("POST", p.url, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		request.Header.Set("Authorization", "Token "+p.token)
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return errors.New(response.Status + " " + strings.TrimSpace(string(message)))
+	}
+	return nil
+}
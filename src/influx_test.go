@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxPusher(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v2/write" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		query := r.URL.Query()
+		if query.Get("org") != "my org" || query.Get("bucket") != "gpus" || query.Get("precision") != "ns" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		content, _ := io.ReadAll(r.Body)
+		body = string(content)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	m := &metricSet{}
+	m.add("nvidiasmi_power_draw_watts", []label{{"uuid", "GPU-0"}, {"name", "Tesla V100, SXM2 = 16GB"}, {"empty", ""}}, "45.12")
+	m.add("nvidiasmi_process_used_memory_bytes", []label{{"process_name", "python train.py\n--lr=1"}}, "1024")
+	m.add("nvidiasmi_process_used_memory_bytes", []label{{"process_name", `C:\Program Files\`}, {"process_pid", "42"}}, "2048")
+	m.add("nvidiasmi_not_a_number", nil, "N/A")
+	p := newInfluxPusher(server.URL+"/", "my org", "gpus", "secret", time.Minute)
+	if err := p.write(m, time.Unix(1700000000, 5)); err != nil {
+		t.Fatal(err)
+	}
+	want := `nvidiasmi_power_draw_watts,uuid=GPU-0,name=Tesla\ V100\,\ SXM2\ \=\ 16GB value=45.12 1700000000000000005` + "\n" +
+		`nvidiasmi_process_used_memory_bytes,process_name=python\ train.py\n--lr\=1 value=1024 1700000000000000005` + "\n" +
+		`nvidiasmi_process_used_memory_bytes,process_name=C:\\Program\ Files\\,process_pid=42 value=2048 1700000000000000005` + "\n"
+	if body != want {
+		t.Errorf("got body\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestInfluxPusherError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	p := newInfluxPusher(server.URL, "org", "bucket", "", time.Minute)
+	err := p.write(&metricSet{}, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "unauthorized access") {
+		t.Errorf("got error %v", err)
+	}
+}
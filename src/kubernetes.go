@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const POD_RESOURCES_TIMEOUT = 2 * time.Second
+const POD_RESOURCES_CACHE_TTL = 10 * time.Second
+
+var pods *podResolver
+
+type podContainer struct {
+	namespace string
+	pod       string
+	container string
+}
+
+// podResolver maps GPU UUIDs to the pods they are allocated to, through the
+// kubelet PodResourcesLister gRPC service.
+type podResolver struct {
+	client  *http.Client
+	mu      sync.Mutex
+	updated time.Time
+	devices map[string][]podContainer
+}
+
+func newPodResolver(socket string) *podResolver {
+	return &podResolver{
+		client:  newGRPCClient("unix", socket, POD_RESOURCES_TIMEOUT),
+		devices: make(map[string][]podContainer),
+	}
+}
+
+// parsePodResources decodes a v1 ListPodResourcesResponse into the
+// containers using each device.
+func parsePodResources(response []byte) (map[string][]podContainer, error) {
+	devices := make(map[string][]podContainer)
+	// ListPodResourcesResponse.pod_resources = 1
+	err := protoFields(response, func(field int, _ uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var pod podContainer
+		var containers [][]byte
+		// PodResources.name = 1, namespace = 2, containers = 3
+		err := protoFields(data, func(field int, _ uint64, data []byte) error {
+			switch field {
+			case 1:
+				pod.pod = string(data)
+			case 2:
+				pod.namespace = string(data)
+			case 3:
+				containers = append(containers, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, data := range containers {
+			container := pod
+			var deviceIds []string
+			// ContainerResources.name = 1, devices = 2
+			err := protoFields(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case 1:
+					container.container = string(data)
+				case 2:
+					// ContainerDevices.device_ids = 2
+					return protoFields(data, func(field int, _ uint64, data []byte) error {
+						if field == 2 {
+							deviceIds = append(deviceIds, string(data))
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, id := range deviceIds {
+				// Shared GPUs are advertised as <uuid>::<replica>
+				uuid := strings.SplitN(id, "::", 2)[0]
+				devices[uuid] = append(devices[uuid], container)
+			}
+		}
+		return nil
+	})
+	for _, containers := range devices {
+		sort.Slice(containers, func(i, j int) bool {
+			a, b := containers[i], containers[j]
+			return a.namespace+"/"+a.pod+"/"+a.container < b.namespace+"/"+b.pod+"/"+b.container
+		})
+	}
+	return devices, err
+}
+
+func (p *podResolver) lookup(uuid string) []podContainer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.updated) > POD_RESOURCES_CACHE_TTL {
+		response, err := grpcInvoke(p.client, "/v1.PodResourcesLister/List", nil, nil)
+		if err == nil {
+			p.devices, err = parsePodResources(response)
+		}
+		if err != nil {
+			log.Print("Kubelet pod resources: " + err.Error())
+		}
+		p.updated = time.Now()
+	}
+	return p.devices[uuid]
+}
+
+// labels returns the pod labels of a GPU. A GPU shared between several
+// containers lists all of them, comma separated.
+func (p *podResolver) labels(uuid string) []label {
+	var namespaces, names, containers []string
+	for _, container := range p.lookup(uuid) {
+		namespaces = append(namespaces, container.namespace)
+		names = append(names, container.pod)
+		containers = append(containers, container.container)
+	}
+	return []label{
+		{"namespace", strings.Join(namespaces, ",")},
+		{"pod", strings.Join(names, ",")},
+		{"container", strings.Join(containers, ",")},
+	}
+}
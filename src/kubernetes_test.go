@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encodePodResources encodes a ListPodResourcesResponse with a pod per
+// container, each container using the given device IDs.
+func encodePodResources(pods []podContainer, deviceIds [][]string) []byte {
+	var response []byte
+	for i, pod := range pods {
+		var devices []byte
+		devices = protoAppendStringField(devices, 1, "nvidia.com/gpu")
+		for _, id := range deviceIds[i] {
+			devices = protoAppendStringField(devices, 2, id)
+		}
+		container := protoAppendStringField(nil, 1, pod.container)
+		container = protoAppendBytesField(container, 2, devices)
+		resources := protoAppendStringField(nil, 1, pod.pod)
+		resources = protoAppendStringField(resources, 2, pod.namespace)
+		resources = protoAppendBytesField(resources, 3, container)
+		response = protoAppendBytesField(response, 1, resources)
+	}
+	return response
+}
+
+// fakeGRPC serves a gRPC handler over cleartext HTTP/2 on a unix socket.
+func fakeGRPC(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket
+}
+
+// grpcRespond writes a gRPC response message followed by the status trailers.
+func grpcRespond(w http.ResponseWriter, message []byte, status string, statusMessage string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	if message != nil {
+		frame := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		w.Write(append(frame, message...))
+	}
+	w.Header().Set("Grpc-Status", status)
+	w.Header().Set("Grpc-Message", statusMessage)
+}
+
+func TestPodResolver(t *testing.T) {
+	pods := []podContainer{
+		{namespace: "ml", pod: "trainer-0", container: "main"},
+		{namespace: "ml", pod: "notebook", container: "jupyter"},
+		{namespace: "dev", pod: "shell", container: "bash"},
+	}
+	deviceIds := [][]string{
+		{"GPU-aaaa"},
+		{"GPU-bbbb::0"},
+		{"GPU-bbbb::1"},
+	}
+	socket := fakeGRPC(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/v1.PodResourcesLister/List" || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("unexpected %s request to %s", r.Proto, r.URL.Path)
+		}
+		request, _ := io.ReadAll(r.Body)
+		if len(request) != 5 {
+			t.Errorf("got request %x, want an empty message", request)
+		}
+		grpcRespond(w, encodePodResources(pods, deviceIds), "0", "")
+	})
+
+	resolver := newPodResolver(socket)
+	tests := map[string][]label{
+		"GPU-aaaa": {{"namespace", "ml"}, {"pod", "trainer-0"}, {"container", "main"}},
+		// Replicas of a shared GPU are reported on the GPU itself
+		"GPU-bbbb": {{"namespace", "dev,ml"}, {"pod", "shell,notebook"}, {"container", "bash,jupyter"}},
+		"GPU-cccc": {{"namespace", ""}, {"pod", ""}, {"container", ""}},
+	}
+	for uuid, want := range tests {
+		if got := resolver.labels(uuid); !reflect.DeepEqual(got, want) {
+			t.Errorf("labels(%s) = %v, want %v", uuid, got, want)
+		}
+	}
+}
+
+func TestGRPCInvokeStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		err     string
+	}{
+		{
+			name: "trailer",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				grpcRespond(w, nil, "7", "permission denied")
+			},
+			err: "status 7 permission denied",
+		},
+		{
+			name: "trailers only",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", "12")
+				w.Header().Set("Grpc-Message", "unknown method")
+			},
+			err: "status 12 unknown method",
+		},
+		{
+			name: "truncated",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.Write([]byte{0, 0, 0, 0, 10, 1})
+				w.Header().Set("Grpc-Status", "0")
+			},
+			err: "truncated response",
+		},
+	}
+	for _, test := range tests {
+		client := newGRPCClient("unix", fakeGRPC(t, test.handler), POD_RESOURCES_TIMEOUT)
+		_, err := grpcInvoke(client, "/v1.PodResourcesLister/List", nil, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestGRPCInvokeMetadata(t *testing.T) {
+	socket := fakeGRPC(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Te") != "trailers" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		request, _ := io.ReadAll(r.Body)
+		grpcRespond(w, request[5:], "0", "")
+	})
+	client := newGRPCClient("unix", socket, POD_RESOURCES_TIMEOUT)
+	metadata := http.Header{"Authorization": {"Bearer token"}}
+	response, err := grpcInvoke(client, "/echo", metadata, []byte("ping"))
+	if err != nil || string(response) != "ping" {
+		t.Errorf("got %q, %v", response, err)
+	}
+}
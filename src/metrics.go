@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var metricsInclude *regexp.Regexp
+var metricsExclude *regexp.Regexp
+
+// gpuLabelNames maps the identity labels of GPU series (id, uuid, name or
+// index) to the label names they are exported as.
+var gpuLabelNames = []label{{"id", "id"}, {"uuid", "uuid"}, {"name", "name"}}
+
+// staticLabels are added to every series.
+var staticLabels []label
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// seriesLabelNames lists the labels added by the collectors besides the GPU
+// identity labels, which configured labels must not collide with.
+var seriesLabelNames = []string{
+	"process_name", "process_pid", "process_type", "container_id", "container_name", "uid", "user",
+	"slurm_job_id", "slurm_user", "slurm_partition", "namespace", "pod", "container",
+	"type", "reason", "link", "peer", "peer_uuid", "connection", "cpu_affinity", "numa_affinity", "xid", "pci_bus_id",
+}
+
+var collectors []collector
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	name   string
+	labels []label
+	value  string
+}
+
+// metricSet holds the samples of a single collection.
+type metricSet struct {
+	samples []sample
+}
+
+func (m *metricSet) add(name string, labels []label, value string) {
+	for _, exported := range exportedNames(name) {
+		if exported == name {
+			m.samples = append(m.samples, sample{name, labels, value})
+		} else {
+			m.samples = append(m.samples, sample{exported, labels, dcgmValue(name, value)})
+		}
+	}
+}
+
+// collector writes the metric families it declares. Collectors without
+// declared families are always run.
+type collector struct {
+	families []string
+	collect  func(m *metricSet, xmlData *NvidiaSmiLog)
+}
+
+func (c collector) enabled() bool {
+	if len(c.families) == 0 {
+		return true
+	}
+	for _, family := range c.families {
+		if metricExported(family) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerCollector adds a collector unless all of its families are
+// filtered out, and tells whether it was added.
+func registerCollector(families []string, collect func(m *metricSet, xmlData *NvidiaSmiLog)) bool {
+	c := collector{families, collect}
+	if !c.enabled() {
+		return false
+	}
+	collectors = append(collectors, c)
+	return true
+}
+
+// counterMetrics lists the counters not following the _total convention.
+var counterMetrics = map[string]bool{
+	"nvidiasmi_pci_replay_counter":          true,
+	"nvidiasmi_pci_replay_rollover_counter": true,
+	"DCGM_FI_DEV_PCIE_REPLAY_COUNTER":       true,
+	"DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION":  true,
+}
+
+func metricType(name string) string {
+	if strings.HasSuffix(name, "_total") || counterMetrics[name] {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// writeMetricSet writes the samples in the Prometheus text format, grouped by
+// metric family as the format requires, each family preceded by its type.
+func writeMetricSet(w io.Writer, m *metricSet) {
+	var names []string
+	families := make(map[string][]sample)
+	for _, s := range m.samples {
+		if _, ok := families[s.name]; !ok {
+			names = append(names, s.name)
+		}
+		families[s.name] = append(families[s.name], s)
+	}
+	for _, name := range names {
+		io.WriteString(w, "# TYPE "+name+" "+metricType(name)+"\n")
+		for _, s := range families[name] {
+			io.WriteString(w, formatValue(s))
+		}
+	}
+}
+
+// metricEnabled tells whether a metric family passes the METRICS_INCLUDE and
+// METRICS_EXCLUDE patterns.
+func metricEnabled(name string) bool {
+	if metricsInclude != nil && !metricsInclude.MatchString(name) {
+		return false
+	}
+	return metricsExclude == nil || !metricsExclude.MatchString(name)
+}
+
+func compileMetricsPattern(key string) *regexp.Regexp {
+	pattern := getenv(key, "")
+	if pattern == "" {
+		return nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatal("Invalid " + key + ": " + err.Error())
+	}
+	return r
+}
+
+// parseLabelList parses a comma separated list of name=value pairs. Entries
+// without a value take their name as value.
+func parseLabelList(key string) []label {
+	var labels []label
+	for _, entry := range strings.Split(getenv(key, ""), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pair := strings.SplitN(entry, "=", 2)
+		l := label{strings.TrimSpace(pair[0]), strings.TrimSpace(pair[0])}
+		if len(pair) == 2 {
+			l.value = strings.TrimSpace(pair[1])
+		}
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+// checkLabelName exits when a configured label name is invalid or already
+// used, recording it as used otherwise.
+func checkLabelName(key string, name string, used map[string]bool) {
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		log.Fatal("Invalid " + key + ": invalid label name " + name)
+	}
+	if used[name] {
+		log.Fatal("Invalid " + key + ": label name " + name + " is already used")
+	}
+	used[name] = true
+}
+
+func reservedLabelNames() map[string]bool {
+	used := make(map[string]bool)
+	for _, name := range seriesLabelNames {
+		used[name] = true
+	}
+	return used
+}
+
+// parseGPULabels reads GPU_LABELS, such as index=gpu,uuid=UUID,name=modelName.
+func parseGPULabels() []label {
+	labels := parseLabelList("GPU_LABELS")
+	if labels == nil {
+		if metricsNaming == NAMING_DCGM {
+			return dcgmGPULabels
+		}
+		return gpuLabelNames
+	}
+	used := reservedLabelNames()
+	for _, l := range labels {
+		switch l.name {
+		case "id", "uuid", "name", "index":
+		default:
+			log.Fatal("Invalid GPU_LABELS: unknown label " + l.name)
+		}
+		// The PCI bus ID label of the Xid series is then left out
+		if l.name == "id" && l.value == "pci_bus_id" {
+			delete(used, "pci_bus_id")
+		}
+		checkLabelName("GPU_LABELS", l.value, used)
+	}
+	return labels
+}
+
+// parseStaticLabels reads STATIC_LABELS, such as cluster=a,rack=b. It must be
+// called after the GPU labels are known.
+func parseStaticLabels() []label {
+	labels := parseLabelList("STATIC_LABELS")
+	used := reservedLabelNames()
+	for _, l := range gpuLabelNames {
+		used[l.value] = true
+	}
+	for _, l := range labels {
+		checkLabelName("STATIC_LABELS", l.name, used)
+	}
+	return labels
+}
+
+// withLabels returns a copy of labels extended with more labels, so that
+// samples never share their label slices.
+func withLabels(labels []label, more ...label) []label {
+	result := make([]label, 0, len(labels)+len(more))
+	result = append(result, labels...)
+	return append(result, more...)
+}
+
+// collect queries nvidia-smi and runs every registered collector.
+func collect() (*metricSet, error) {
+	xmlData, err := queryNvidiaSmi()
+	if err != nil {
+		return nil, err
+	}
+	m := &metricSet{}
+	for _, c := range collectors {
+		c.collect(m, xmlData)
+	}
+	if len(staticLabels) > 0 {
+		for i := range m.samples {
+			m.samples[i].labels = withLabels(m.samples[i].labels, staticLabels...)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var nvlinkGPURegexp = regexp.MustCompile(`^GPU (\d+): (.*) \(UUID: (.*)\)$`)
+var nvlinkLinkRegexp = regexp.MustCompile(`^Link (\d+): (.*)$`)
+var nvlinkNameRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// nvlinkReading is a single "Link N: [key: ]value" line of nvidia-smi nvlink
+// output, attached to the GPU header preceding it.
+type nvlinkReading struct {
+	uuid  string
+	name  string
+	link  string
+	key   string
+	value string
+}
+
+func parseNvlink(output []byte) []nvlinkReading {
+	var readings []nvlinkReading
+	var uuid, name string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := nvlinkGPURegexp.FindStringSubmatch(line); match != nil {
+			name = match[2]
+			uuid = match[3]
+			continue
+		}
+		match := nvlinkLinkRegexp.FindStringSubmatch(line)
+		if match == nil || uuid == "" {
+			continue
+		}
+		reading := nvlinkReading{uuid: uuid, name: name, link: match[1], value: match[2]}
+		if i := strings.LastIndex(reading.value, ": "); i >= 0 {
+			reading.key = reading.value[:i]
+			reading.value = reading.value[i+2:]
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+func runNvlink(sample string, args ...string) []nvlinkReading {
+	stdout, err := nvidiaSmiCommand(sample, append([]string{"nvlink"}, args...)...).Output()
+	if err != nil {
+		log.Print("nvidia-smi nvlink " + strings.Join(args, " ") + ": " + err.Error())
+		return nil
+	}
+	return parseNvlink(stdout)
+}
+
+// nvlinkMetricName turns an nvidia-smi label such as "CRC Flit Errors" into
+// a metric name such as nvidiasmi_nvlink_crc_flit_errors_total.
+func nvlinkMetricName(key string) string {
+	return "nvidiasmi_nvlink_" + strings.Trim(nvlinkNameRegexp.ReplaceAllString(strings.ToLower(key), "_"), "_") + "_total"
+}
+
+// Error counters depend on the GPU generation, such as "CRC Errors" or
+// "CRC Flit Errors" and "CRC Data Errors".
+var nvlinkErrorFamilies = []string{
+	"nvidiasmi_nvlink_replay_errors_total",
+	"nvidiasmi_nvlink_recovery_errors_total",
+	"nvidiasmi_nvlink_crc_errors_total",
+	"nvidiasmi_nvlink_crc_flit_errors_total",
+	"nvidiasmi_nvlink_crc_data_errors_total",
+}
+
+// nvlinkLabels returns the labels of the link of a reading, along with
+// whether its GPU is selected.
+func nvlinkLabels(xmlData *NvidiaSmiLog, reading nvlinkReading) ([]label, bool) {
+	for _, GPU := range xmlData.GPU {
+		if GPU.UUID == reading.uuid {
+			return withLabels(gpuLabels(GPU.Id, reading.uuid, reading.name), label{"link", reading.link}), true
+		}
+	}
+	return nil, false
+}
+
+func registerNvlinkCollectors() {
+	registerCollector([]string{"nvidiasmi_nvlink_active", "nvidiasmi_nvlink_speed_bytes_per_second"}, collectNvlinkStatus)
+	registerCollector([]string{"nvidiasmi_nvlink_tx_bytes_total", "nvidiasmi_nvlink_rx_bytes_total"}, collectNvlinkThroughput)
+	registerCollector(nvlinkErrorFamilies, collectNvlinkErrors)
+}
+
+func collectNvlinkStatus(m *metricSet, xmlData *NvidiaSmiLog) {
+	for _, reading := range runNvlink("nvidia-smi-nvlink-status.sample.txt", "--status") {
+		labels, ok := nvlinkLabels(xmlData, reading)
+		if !ok {
+			continue
+		}
+		active := "1"
+		if reading.value == "<inactive>" {
+			active = "0"
+		}
+		m.add("nvidiasmi_nvlink_active", labels, active)
+		if active == "1" {
+			m.add("nvidiasmi_nvlink_speed_bytes_per_second", labels, filterUnit(reading.value))
+		}
+	}
+}
+
+func collectNvlinkThroughput(m *metricSet, xmlData *NvidiaSmiLog) {
+	for _, reading := range runNvlink("nvidia-smi-nvlink-throughput.sample.txt", "-gt", "d") {
+		labels, ok := nvlinkLabels(xmlData, reading)
+		if !ok {
+			continue
+		}
+		switch reading.key {
+		case "Data Tx":
+			m.add("nvidiasmi_nvlink_tx_bytes_total", labels, filterUnit(reading.value))
+		case "Data Rx":
+			m.add("nvidiasmi_nvlink_rx_bytes_total", labels, filterUnit(reading.value))
+		}
+	}
+}
+
+func collectNvlinkErrors(m *metricSet, xmlData *NvidiaSmiLog) {
+	for _, reading := range runNvlink("nvidia-smi-nvlink-errors.sample.txt", "-e") {
+		labels, ok := nvlinkLabels(xmlData, reading)
+		if ok && reading.key != "" {
+			m.add(nvlinkMetricName(reading.key), labels, filterNumber(reading.value))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseNvlink(t *testing.T) {
+	const uuid = "GPU-cf5ce50c-9d96-5da7-adb6-b662d5afe4bc"
+	tests := []struct {
+		fixture string
+		count   int
+		want    map[int]nvlinkReading
+	}{
+		{
+			fixture: "../nvidia-smi-nvlink-status.sample.txt",
+			count:   4,
+			want: map[int]nvlinkReading{
+				0: {uuid: uuid, name: "GeForce GTX 980", link: "0", value: "25.781 GB/s"},
+				3: {uuid: uuid, name: "GeForce GTX 980", link: "3", value: "<inactive>"},
+			},
+		},
+		{
+			fixture: "../nvidia-smi-nvlink-throughput.sample.txt",
+			count:   8,
+			want: map[int]nvlinkReading{
+				0: {uuid: uuid, name: "GeForce GTX 980", link: "0", key: "Data Tx", value: "73625182 KiB"},
+				3: {uuid: uuid, name: "GeForce GTX 980", link: "1", key: "Data Rx", value: "71901938 KiB"},
+			},
+		},
+		{
+			fixture: "../nvidia-smi-nvlink-errors.sample.txt",
+			count:   12,
+			want: map[int]nvlinkReading{
+				3: {uuid: uuid, name: "GeForce GTX 980", link: "1", key: "Replay Errors", value: "3"},
+				5: {uuid: uuid, name: "GeForce GTX 980", link: "1", key: "CRC Errors", value: "12"},
+			},
+		},
+	}
+	for _, test := range tests {
+		output, err := os.ReadFile(test.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readings := parseNvlink(output)
+		if len(readings) != test.count {
+			t.Errorf("%s: got %d readings, want %d", test.fixture, len(readings), test.count)
+			continue
+		}
+		for i, want := range test.want {
+			if readings[i] != want {
+				t.Errorf("%s: reading %d is %+v, want %+v", test.fixture, i, readings[i], want)
+			}
+		}
+	}
+}
+
+func TestParseNvlinkMultipleGPUs(t *testing.T) {
+	output := []byte("GPU 0: A100-SXM4-40GB (UUID: GPU-0)\n" +
+		"\t Link 0: CRC Flit Errors: 1\n" +
+		"GPU 1: A100-SXM4-40GB (UUID: GPU-1)\n" +
+		"\t Link 0: CRC Data Errors: 2\n")
+	readings := parseNvlink(output)
+	if len(readings) != 2 || readings[0].uuid != "GPU-0" || readings[1].uuid != "GPU-1" {
+		t.Fatalf("got %+v", readings)
+	}
+}
+
+func TestNvlinkMetricName(t *testing.T) {
+	tests := map[string]string{
+		"Replay Errors":   "nvidiasmi_nvlink_replay_errors_total",
+		"Recovery Errors": "nvidiasmi_nvlink_recovery_errors_total",
+		"CRC Errors":      "nvidiasmi_nvlink_crc_errors_total",
+		"CRC Flit Errors": "nvidiasmi_nvlink_crc_flit_errors_total",
+		"CRC Data Errors": "nvidiasmi_nvlink_crc_data_errors_total",
+		" Odd-Key (x) ":   "nvidiasmi_nvlink_odd_key_x_total",
+	}
+	for key, want := range tests {
+		if got := nvlinkMetricName(key); got != want {
+			t.Errorf("nvlinkMetricName(%q) = %q, want %q", key, got, want)
+		}
+	}
+	for _, family := range nvlinkErrorFamilies {
+		found := false
+		for key := range tests {
+			found = found || nvlinkMetricName(key) == family
+		}
+		if !found {
+			t.Errorf("no nvidia-smi key maps to %s", family)
+		}
+	}
+}
+
+func TestFilterUnitNvlink(t *testing.T) {
+	tests := map[string]string{
+		"25.781 GB/s":  "2.5781e+10",
+		"73625182 KiB": "7.5392186368e+10",
+		"0 KiB":        "0",
+		"<inactive>":   "0",
+	}
+	for value, want := range tests {
+		if got := filterUnit(value); got != want {
+			t.Errorf("filterUnit(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OTLP_TIMEOUT = 10 * time.Second
+const OTLP_GRPC_METHOD = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// Counters are cumulative since the exporter started
+var otlpStartTime = time.Now()
+
+// UCUM units of the Prometheus unit suffixes
+var otlpUnits = [][2]string{
+	{"_bytes", "By"},
+	{"_bytes_per_second", "By/s"},
+	{"_hertz", "Hz"},
+	{"_watts", "W"},
+	{"_celsius", "Cel"},
+	{"_percent", "%"},
+	{"_seconds", "s"},
+	{"_joules", "J"},
+}
+
+// otlpUnit returns the unit of a metric from its name.
+func otlpUnit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	for _, suffix := range otlpUnits {
+		if strings.HasSuffix(name, suffix[0]) {
+			return suffix[1]
+		}
+	}
+	return ""
+}
+
+func otlpKeyValue(key string, value string) []byte {
+	// AnyValue.string_value = 1
+	anyValue := protoAppendStringField(nil, 1, value)
+	// KeyValue.key = 1, value = 2
+	b := protoAppendStringField(nil, 1, key)
+	return protoAppendBytesField(b, 2, anyValue)
+}
+
+// otlpMetric encodes the samples of a metric family as a Metric message, or
+// returns nil when none of them has a numeric value.
+func otlpMetric(name string, samples []sample, resourceLabel string, now time.Time) []byte {
+	var points [][]byte
+	for _, s := range samples {
+		value, err := strconv.ParseFloat(s.value, 64)
+		if err != nil {
+			continue
+		}
+		var point []byte
+		// NumberDataPoint.attributes = 7, start_time_unix_nano = 2,
+		// time_unix_nano = 3, as_double = 4
+		for _, l := range s.labels {
+			if l.name != resourceLabel {
+				point = protoAppendBytesField(point, 7, otlpKeyValue(l.name, l.value))
+			}
+		}
+		if metricType(name) == "counter" {
+			point = protoAppendFixed64Field(point, 2, uint64(otlpStartTime.UnixNano()))
+		}
+		point = protoAppendFixed64Field(point, 3, uint64(now.UnixNano()))
+		point = protoAppendDoubleField(point, 4, value)
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	var data []byte
+	// Gauge.data_points = 1, Sum.data_points = 1
+	for _, point := range points {
+		data = protoAppendBytesField(data, 1, point)
+	}
+	// Metric.name = 1, unit = 3, gauge = 5, sum = 7
+	b := protoAppendStringField(nil, 1, name)
+	if unit := otlpUnit(name); unit != "" {
+		b = protoAppendStringField(b, 3, unit)
+	}
+	if metricType(name) == "counter" {
+		// Sum.aggregation_temporality = 2 (cumulative), is_monotonic = 3
+		data = protoAppendVarintField(data, 2, 2)
+		data = protoAppendVarintField(data, 3, 1)
+		return protoAppendBytesField(b, 7, data)
+	}
+	return protoAppendBytesField(b, 5, data)
+}
+
+// encodeOTLP encodes the samples as an ExportMetricsServiceRequest, with one
+// resource per GPU identified by the host name and the GPU UUID.
+func encodeOTLP(m *metricSet, hostname string, now time.Time) []byte {
+	// The GPU UUID moves to the resource attributes, under the label name
+	// configured by GPU_LABELS
+	resourceLabel := ""
+	for _, l := range gpuLabelNames {
+		if l.name == "uuid" {
+			resourceLabel = l.value
+		}
+	}
+
+	var uuids []string
+	resources := make(map[string]*metricSet)
+	for _, s := range m.samples {
+		uuid := ""
+		for _, l := range s.labels {
+			if l.name == resourceLabel {
+				uuid = l.value
+			}
+		}
+		if resources[uuid] == nil {
+			uuids = append(uuids, uuid)
+			resources[uuid] = &metricSet{}
+		}
+		resources[uuid].samples = append(resources[uuid].samples, s)
+	}
+
+	var request []byte
+	for _, uuid := range uuids {
+		// Resource.attributes = 1
+		resource := protoAppendBytesField(nil, 1, otlpKeyValue("host.name", hostname))
+		if uuid != "" {
+			resource = protoAppendBytesField(resource, 1, otlpKeyValue("gpu.uuid", uuid))
+		}
+
+		// InstrumentationScope.name = 1
+		scopeMetrics := protoAppendBytesField(nil, 1, protoAppendStringField(nil, 1, "nvidiasmi"))
+		var names []string
+		families := make(map[string][]sample)
+		for _, s := range resources[uuid].samples {
+			if _, ok := families[s.name]; !ok {
+				names = append(names, s.name)
+			}
+			families[s.name] = append(families[s.name], s)
+		}
+		// ScopeMetrics.scope = 1, metrics = 2
+		for _, name := range names {
+			if metric := otlpMetric(name, families[name], resourceLabel, now); metric != nil {
+				scopeMetrics = protoAppendBytesField(scopeMetrics, 2, metric)
+			}
+		}
+
+		// ResourceMetrics.resource = 1, scope_metrics = 2
+		resourceMetrics := protoAppendBytesField(nil, 1, resource)
+		resourceMetrics = protoAppendBytesField(resourceMetrics, 2, scopeMetrics)
+		// ExportMetricsServiceRequest.resource_metrics = 1
+		request = protoAppendBytesField(request, 1, resourceMetrics)
+	}
+	return request
+}
+
+// otlpPusher exports the metrics to an OpenTelemetry collector, over HTTP or
+// cleartext gRPC.
+type otlpPusher struct {
+	client   *http.Client
+	protocol string
+	endpoint string
+	headers  http.Header
+	hostname string
+	interval time.Duration
+}
+
+func newOTLPPusher(endpoint string, protocol string, headers http.Header, interval time.Duration) *otlpPusher {
+	hostname, _ := os.Hostname()
+	p := &otlpPusher{
+		protocol: protocol,
+		headers:  headers,
+		hostname: hostname,
+		interval: interval,
+	}
+	switch protocol {
+	case "grpc":
+		address := strings.TrimPrefix(endpoint, "http://")
+		if strings.Contains(address, "://") {
+			log.Fatal("Invalid OTLP_ENDPOINT: " + endpoint + ", gRPC exports are cleartext only, use host:port or http://host:port")
+		}
+		p.client = newGRPCClient("tcp", strings.TrimSuffix(address, "/"), OTLP_TIMEOUT)
+	case "http/protobuf":
+		p.client = &http.Client{Timeout: OTLP_TIMEOUT}
+		p.endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/metrics"
+	default:
+		log.Fatal("Invalid OTLP_PROTOCOL: " + protocol)
+	}
+	return p
+}
+
+func (p *otlpPusher) run() {
+	for range time.Tick(p.interval) {
+		if err := p.push(); err != nil {
+			log.Print("OTLP export: " + err.Error())
+		}
+	}
+}
+
+func (p *otlpPusher) push() error {
+	m, err := collect()
+	if err != nil {
+		return err
+	}
+	return p.export(m, time.Now())
+}
+
+// export sends the samples to the collector.
+func (p *otlpPusher) export(m *metricSet, now time.Time) error {
+	request := encodeOTLP(m, p.hostname, now)
+	if p.protocol == "grpc" {
+		_, err := grpcInvoke(p.client, OTLP_GRPC_METHOD, p.headers, request)
+		return err
+	}
+
+	httpRequest, err := http.NewRequest("POST", p.endpoint, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	for key, values := range p.headers {
+		httpRequest.Header[key] = values
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	response, err := p.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return errors.New(response.Status + " " + strings.TrimSpace(string(message)))
+	}
+	return nil
+}
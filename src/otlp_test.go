@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type otlpTestPoint struct {
+	attributes map[string]string
+	start      uint64
+	time       uint64
+	value      float64
+}
+
+type otlpTestMetric struct {
+	name        string
+	unit        string
+	kind        string
+	temporality uint64
+	monotonic   uint64
+	points      []otlpTestPoint
+}
+
+type otlpTestResource struct {
+	attributes map[string]string
+	scope      string
+	metrics    []otlpTestMetric
+}
+
+// decodeKeyValue decodes a KeyValue with a string value into attributes.
+func decodeKeyValue(data []byte, attributes map[string]string) error {
+	var key, value string
+	err := protoFields(data, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			key = string(data)
+		case 2:
+			return protoFields(data, func(field int, _ uint64, data []byte) error {
+				if field == 1 {
+					value = string(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	attributes[key] = value
+	return err
+}
+
+func decodeOTLPMetric(data []byte) (otlpTestMetric, error) {
+	var metric otlpTestMetric
+	err := protoFields(data, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			metric.name = string(data)
+		case 3:
+			metric.unit = string(data)
+		case 5, 7:
+			metric.kind = map[int]string{5: "gauge", 7: "sum"}[field]
+			return protoFields(data, func(field int, value uint64, data []byte) error {
+				switch field {
+				case 1:
+					point := otlpTestPoint{attributes: make(map[string]string)}
+					err := protoFields(data, func(field int, value uint64, data []byte) error {
+						switch field {
+						case 7:
+							return decodeKeyValue(data, point.attributes)
+						case 2:
+							point.start = value
+						case 3:
+							point.time = value
+						case 4:
+							point.value = math.Float64frombits(value)
+						}
+						return nil
+					})
+					metric.points = append(metric.points, point)
+					return err
+				case 2:
+					metric.temporality = value
+				case 3:
+					metric.monotonic = value
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return metric, err
+}
+
+// decodeOTLP decodes an ExportMetricsServiceRequest.
+func decodeOTLP(t *testing.T, request []byte) []otlpTestResource {
+	t.Helper()
+	var resources []otlpTestResource
+	err := protoFields(request, func(field int, _ uint64, data []byte) error {
+		resource := otlpTestResource{attributes: make(map[string]string)}
+		err := protoFields(data, func(field int, _ uint64, data []byte) error {
+			switch field {
+			case 1:
+				return protoFields(data, func(field int, _ uint64, data []byte) error {
+					return decodeKeyValue(data, resource.attributes)
+				})
+			case 2:
+				return protoFields(data, func(field int, _ uint64, data []byte) error {
+					switch field {
+					case 1:
+						return protoFields(data, func(field int, _ uint64, data []byte) error {
+							if field == 1 {
+								resource.scope = string(data)
+							}
+							return nil
+						})
+					case 2:
+						metric, err := decodeOTLPMetric(data)
+						resource.metrics = append(resource.metrics, metric)
+						return err
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		resources = append(resources, resource)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resources
+}
+
+func otlpTestMetricSet() *metricSet {
+	m := &metricSet{}
+	gpu0 := []label{{"id", "00000000:01:00.0"}, {"uuid", "GPU-0"}, {"name", "Tesla T4"}}
+	gpu1 := []label{{"id", "00000000:02:00.0"}, {"uuid", "GPU-1"}, {"name", "Tesla T4"}}
+	m.add("nvidiasmi_power_draw_watts", gpu0, "45.5")
+	m.add("nvidiasmi_power_draw_watts", gpu1, "60")
+	m.add("nvidiasmi_energy_consumption_joules_total", gpu0, "1000")
+	m.add("nvidiasmi_xid_errors_total", withLabels(gpu1, label{"xid", "79"}), "1")
+	m.add("nvidiasmi_slurm_job_gpus", []label{{"slurm_job_id", "7"}}, "2")
+	// Values which are not numbers are left out
+	m.add("nvidiasmi_clocks_throttle_reason_active", gpu0, "N/A")
+	return m
+}
+
+func checkOTLPRequest(t *testing.T, request []byte, now time.Time) {
+	t.Helper()
+	point := func(value float64, start time.Time, attributes ...string) otlpTestPoint {
+		p := otlpTestPoint{attributes: make(map[string]string), time: uint64(now.UnixNano()), value: value}
+		if !start.IsZero() {
+			p.start = uint64(start.UnixNano())
+		}
+		for i := 0; i < len(attributes); i += 2 {
+			p.attributes[attributes[i]] = attributes[i+1]
+		}
+		return p
+	}
+	want := []otlpTestResource{
+		{
+			attributes: map[string]string{"host.name": "gpu-host", "gpu.uuid": "GPU-0"},
+			scope:      "nvidiasmi",
+			metrics: []otlpTestMetric{
+				{name: "nvidiasmi_power_draw_watts", unit: "W", kind: "gauge", points: []otlpTestPoint{point(45.5, time.Time{}, "id", "00000000:01:00.0", "name", "Tesla T4")}},
+				{name: "nvidiasmi_energy_consumption_joules_total", unit: "J", kind: "sum", temporality: 2, monotonic: 1, points: []otlpTestPoint{point(1000, otlpStartTime, "id", "00000000:01:00.0", "name", "Tesla T4")}},
+			},
+		},
+		{
+			attributes: map[string]string{"host.name": "gpu-host", "gpu.uuid": "GPU-1"},
+			scope:      "nvidiasmi",
+			metrics: []otlpTestMetric{
+				{name: "nvidiasmi_power_draw_watts", unit: "W", kind: "gauge", points: []otlpTestPoint{point(60, time.Time{}, "id", "00000000:02:00.0", "name", "Tesla T4")}},
+				{name: "nvidiasmi_xid_errors_total", kind: "sum", temporality: 2, monotonic: 1, points: []otlpTestPoint{point(1, otlpStartTime, "id", "00000000:02:00.0", "name", "Tesla T4", "xid", "79")}},
+			},
+		},
+		{
+			attributes: map[string]string{"host.name": "gpu-host"},
+			scope:      "nvidiasmi",
+			metrics: []otlpTestMetric{
+				{name: "nvidiasmi_slurm_job_gpus", kind: "gauge", points: []otlpTestPoint{point(2, time.Time{}, "slurm_job_id", "7")}},
+			},
+		},
+	}
+	if got := decodeOTLP(t, request); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEncodeOTLP(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	checkOTLPRequest(t, encodeOTLP(otlpTestMetricSet(), "gpu-host", now), now)
+}
+
+func TestOTLPPusherHTTP(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Api-Key") != "secret" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		request, _ := io.ReadAll(r.Body)
+		checkOTLPRequest(t, request, now)
+	}))
+	defer server.Close()
+
+	p := newOTLPPusher(server.URL+"/", "http/protobuf", http.Header{"Api-Key": {"secret"}}, time.Minute)
+	p.hostname = "gpu-host"
+	if err := p.export(otlpTestMetricSet(), now); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOTLPPusherGRPC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != OTLP_GRPC_METHOD {
+			t.Errorf("unexpected %s request to %s", r.Proto, r.URL.Path)
+		}
+		if r.Header.Get("Api-Key") != "secret" {
+			t.Errorf("unexpected metadata %v", r.Header)
+		}
+		request, _ := io.ReadAll(r.Body)
+		checkOTLPRequest(t, request[5:], now)
+		// An empty ExportMetricsServiceResponse
+		grpcRespond(w, []byte{}, "0", "")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	for _, endpoint := range []string{server.Listener.Addr().String(), server.URL} {
+		p := newOTLPPusher(endpoint, "grpc", http.Header{"Api-Key": {"secret"}}, time.Minute)
+		p.hostname = "gpu-host"
+		if err := p.export(otlpTestMetricSet(), now); err != nil {
+			t.Errorf("%s: %v", endpoint, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var pcie = newPCIeCounter()
+
+var pcieFamilies = []string{
+	"nvidiasmi_pci_replay_counter",
+	"nvidiasmi_pci_replay_rollover_counter",
+	"nvidiasmi_pci_replays_total",
+	"nvidiasmi_pci_link_gen_ratio",
+	"nvidiasmi_pci_link_width_ratio",
+	"nvidiasmi_pci_link_degraded",
+}
+
+// pcieCounter keeps a monotonic total of the PCIe replays of each GPU. The
+// driver counters restart from zero when the driver is reloaded or the GPU
+// is reset.
+type pcieCounter struct {
+	mu    sync.Mutex
+	last  map[string]float64
+	total map[string]float64
+}
+
+func newPCIeCounter() *pcieCounter {
+	return &pcieCounter{
+		last:  make(map[string]float64),
+		total: make(map[string]float64),
+	}
+}
+
+// add accounts for the current value of the replay counter of a GPU and
+// returns the total. The rollover counter counts wraps of the replay number
+// of the link, a different event, and is only exported as is.
+func (p *pcieCounter) add(uuid string, value float64) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, ok := p.last[uuid]
+	switch {
+	case !ok:
+		p.total[uuid] = value
+	case value >= last:
+		p.total[uuid] += value - last
+	default:
+		p.total[uuid] += value
+	}
+	p.last[uuid] = value
+	return p.total[uuid]
+}
+
+// linkRatio returns current/max of a PCIe link generation or width, or 1 when
+// either is unknown.
+func linkRatio(current string, max string) float64 {
+	c, err := strconv.ParseFloat(filterNumber(current), 64)
+	if err != nil {
+		return 1
+	}
+	m, err := strconv.ParseFloat(filterNumber(max), 64)
+	if err != nil || m == 0 {
+		return 1
+	}
+	return c / m
+}
+
+// collect outputs the PCIe replay counters and link degradation. GPUs lower
+// their link generation when idle to save power, so only a narrower link
+// than supported counts as degraded.
+func (p *pcieCounter) collect(m *metricSet, xmlData *NvidiaSmiLog) {
+	for _, GPU := range xmlData.GPU {
+		meta := gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		replays, _ := strconv.ParseFloat(filterNumber(GPU.PCI.ReplayCounter), 64)
+		rollovers, _ := strconv.ParseFloat(filterNumber(GPU.PCI.ReplayRolloverCounter), 64)
+		m.add("nvidiasmi_pci_replay_counter", meta, fmt.Sprintf("%g", replays))
+		m.add("nvidiasmi_pci_replay_rollover_counter", meta, fmt.Sprintf("%g", rollovers))
+		m.add("nvidiasmi_pci_replays_total", meta, fmt.Sprintf("%g", p.add(GPU.UUID, replays)))
+
+		link := GPU.PCI.GPULinkInfo
+		widthRatio := linkRatio(link.LinkWidth.Current, link.LinkWidth.Max)
+		m.add("nvidiasmi_pci_link_gen_ratio", meta, fmt.Sprintf("%g", linkRatio(link.PCIeGen.Current, link.PCIeGen.Max)))
+		m.add("nvidiasmi_pci_link_width_ratio", meta, fmt.Sprintf("%g", widthRatio))
+		degraded := "0"
+		if widthRatio < 1 {
+			degraded = "1"
+		}
+		m.add("nvidiasmi_pci_link_degraded", meta, degraded)
+	}
+}
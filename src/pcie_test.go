@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestPCIeCounter(t *testing.T) {
+	p := newPCIeCounter()
+	// The counter restarts from zero after a driver reload or a GPU reset
+	for i, test := range []struct{ value, total float64 }{{5, 5}, {5, 5}, {8, 8}, {2, 10}, {3, 11}} {
+		if got := p.add("GPU-0", test.value); got != test.total {
+			t.Errorf("sample %d: got total %g, want %g", i, got, test.total)
+		}
+	}
+}
+
+func TestPCIeCollect(t *testing.T) {
+	xmlData := readSampleXML(t, "../nvidia-smi.sample.xml")
+	GPU := &xmlData.GPU[0]
+	GPU.PCI.ReplayCounter = "12"
+	GPU.PCI.ReplayRolloverCounter = "3"
+
+	p := newPCIeCounter()
+	m := &metricSet{}
+	p.collect(m, xmlData)
+	values := make(map[string]string)
+	for _, s := range m.samples {
+		values[s.name] = s.value
+	}
+	if values["nvidiasmi_pci_replay_counter"] != "12" || values["nvidiasmi_pci_replay_rollover_counter"] != "3" {
+		t.Errorf("got counters %v", values)
+	}
+	// Rollovers are not replays
+	if values["nvidiasmi_pci_replays_total"] != "12" {
+		t.Errorf("got replays total %s, want 12", values["nvidiasmi_pci_replays_total"])
+	}
+	if values["nvidiasmi_pci_link_width_ratio"] != "1" || values["nvidiasmi_pci_link_degraded"] != "0" {
+		t.Errorf("got link width ratio %s, degraded %s", values["nvidiasmi_pci_link_width_ratio"], values["nvidiasmi_pci_link_degraded"])
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DOCKER_TIMEOUT = 2 * time.Second
+
+// Container names are cached, and so are failed lookups, for shorter, so
+// that containers unknown to Docker do not cost a request on every scrape.
+const DOCKER_NAME_TTL = 10 * time.Minute
+const DOCKER_FAILURE_TTL = 1 * time.Minute
+const PROCESS_NAME_REDACTED = "***"
+
+var containers *containerResolver
+var owners *ownerResolver
+
+var processNameBasename bool
+var processNameProcRoot = "/proc"
+var processNameRedact *regexp.Regexp
+
+// Matches the container ID ending a cgroup path, such as
+// /docker/<id> (cgroup v1) or /system.slice/docker-<id>.scope (cgroup v2).
+var cgroupContainerRegexp = regexp.MustCompile(`[/-]([0-9a-f]{64})(\.scope)?$`)
+
+// sanitizeProcessName shortens the command line reported by nvidia-smi to
+// the executable name when configured so, and redacts secrets from it.
+func sanitizeProcessName(pid string, name string) string {
+	if processNameBasename {
+		name = executableName(pid, name)
+	}
+	if processNameRedact != nil {
+		name = processNameRedact.ReplaceAllString(name, PROCESS_NAME_REDACTED)
+	}
+	return name
+}
+
+// executableName returns the name of the executable of a process, from its
+// /proc/<pid>/exe link, which requires the privileges to trace the process,
+// or its /proc/<pid>/comm, truncated to 15 characters by the kernel. When
+// neither is readable it falls back on the first word of the command line,
+// which cuts executable paths containing spaces short.
+func executableName(pid string, commandLine string) string {
+	if exe, err := os.Readlink(processNameProcRoot + "/" + pid + "/exe"); err == nil && exe != "" {
+		return path.Base(strings.TrimSuffix(exe, " (deleted)"))
+	}
+	if comm, err := os.ReadFile(processNameProcRoot + "/" + pid + "/comm"); err == nil {
+		if name := strings.TrimSpace(string(comm)); name != "" {
+			return name
+		}
+	}
+	if fields := strings.Fields(commandLine); len(fields) > 0 {
+		return path.Base(fields[0])
+	}
+	return commandLine
+}
+
+// processLabels returns the labels identifying a GPU process.
+func processLabels(Process ProcessInfo) []label {
+	labels := []label{{"process_name", sanitizeProcessName(Process.Pid, Process.ProcessName)}, {"process_pid", Process.Pid}, {"process_type", Process.Type}}
+	if containers != nil {
+		id, name := containers.resolve(Process.Pid)
+		labels = append(labels, label{"container_id", id})
+		if containers.client != nil {
+			labels = append(labels, label{"container_name", name})
+		}
+	}
+	if owners != nil {
+		uid, name := owners.resolve(Process.Pid)
+		labels = append(labels, label{"uid", uid}, label{"user", name})
+	}
+	if slurm != nil {
+		labels = append(labels, slurm.resolve(Process.Pid).labels()...)
+	}
+	return labels
+}
+
+// ownerResolver maps host PIDs to the real user they run as.
+type ownerResolver struct {
+	procRoot string
+	mu       sync.Mutex
+	names    map[string]string
+}
+
+func newOwnerResolver(procRoot string) *ownerResolver {
+	return &ownerResolver{
+		procRoot: procRoot,
+		names:    make(map[string]string),
+	}
+}
+
+// uidFromStatus returns the real user ID found in the content of a
+// /proc/<pid>/status file.
+func uidFromStatus(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		// Uid: real, effective, saved set and filesystem user IDs
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// resolve returns the user ID and name of a process, the name falling back
+// on the ID when the user is unknown to the exporter.
+func (o *ownerResolver) resolve(pid string) (string, string) {
+	content, err := os.ReadFile(o.procRoot + "/" + pid + "/status")
+	if err != nil {
+		return "", ""
+	}
+	uid := uidFromStatus(string(content))
+	if uid == "" {
+		return "", ""
+	}
+	return uid, o.userName(uid)
+}
+
+// userName returns the name of a user, or its ID when the user is unknown to
+// the exporter.
+func (o *ownerResolver) userName(uid string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name, ok := o.names[uid]
+	if !ok {
+		name = uid
+		if account, err := user.LookupId(uid); err == nil {
+			name = account.Username
+		}
+		o.names[uid] = name
+	}
+	return name
+}
+
+// containerName is a cached container name, empty when the lookup failed.
+type containerName struct {
+	name    string
+	expires time.Time
+}
+
+// containerResolver maps host PIDs to the container they run in, from their
+// cgroup, and optionally to the container name known by the Docker daemon.
+type containerResolver struct {
+	procRoot string
+	client   *http.Client
+	mu       sync.Mutex
+	names    map[string]containerName
+}
+
+func newContainerResolver(procRoot string, dockerSocket string) *containerResolver {
+	resolver := &containerResolver{
+		procRoot: procRoot,
+		names:    make(map[string]containerName),
+	}
+	if dockerSocket != "" {
+		resolver.client = &http.Client{
+			Timeout: DOCKER_TIMEOUT,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", dockerSocket)
+				},
+			},
+		}
+	}
+	return resolver
+}
+
+// containerIDFromCgroup returns the container ID found in the content of a
+// /proc/<pid>/cgroup file, or an empty string for processes on the host.
+func containerIDFromCgroup(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if match := cgroupContainerRegexp.FindStringSubmatch(fields[2]); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+func (c *containerResolver) resolve(pid string) (string, string) {
+	content, err := os.ReadFile(c.procRoot + "/" + pid + "/cgroup")
+	if err != nil {
+		return "", ""
+	}
+	id := containerIDFromCgroup(string(content))
+	if id == "" || c.client == nil {
+		return id, ""
+	}
+	return id, c.containerName(id)
+}
+
+func (c *containerResolver) containerName(id string) string {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.names[id]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.name
+	}
+
+	name, err := c.lookupContainerName(id)
+	ttl := DOCKER_NAME_TTL
+	if err != nil {
+		log.Print("Docker: " + err.Error())
+		ttl = DOCKER_FAILURE_TTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget the containers that are gone
+	for key, cached := range c.names {
+		if !now.Before(cached.expires) {
+			delete(c.names, key)
+		}
+	}
+	c.names[id] = containerName{name: name, expires: now.Add(ttl)}
+	return name
+}
+
+// lookupContainerName asks the Docker daemon for the name of a container.
+func (c *containerResolver) lookupContainerName(id string) (string, error) {
+	response, err := c.client.Get("http://docker/containers/" + id + "/json")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("container " + id + ": " + response.Status)
+	}
+	var container struct {
+		Name string
+	}
+	if err := json.NewDecoder(response.Body).Decode(&container); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(container.Name, "/"), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+)
+
+const testContainerID = "3f4e1c2b9a8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+
+// writeProcFile writes a /proc/<pid>/<name> file under a temporary PROC_ROOT.
+func writeProcFile(t *testing.T, procRoot string, pid string, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(procRoot, pid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, pid, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerIDFromCgroup(t *testing.T) {
+	tests := map[string]string{
+		// cgroup v1
+		"12:pids:/docker/" + testContainerID + "\n" +
+			"11:devices:/docker/" + testContainerID + "\n" +
+			"1:name=systemd:/docker/" + testContainerID + "\n": testContainerID,
+		// cgroup v2
+		"0::/system.slice/docker-" + testContainerID + ".scope\n": testContainerID,
+		// containerd through the kubelet
+		"0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice/cri-containerd-" + testContainerID + ".scope\n": testContainerID,
+		// Host processes
+		"0::/user.slice/user-1000.slice/session-2.scope\n": "",
+		"0::/init.scope\n": "",
+		"":                 "",
+	}
+	for content, want := range tests {
+		if got := containerIDFromCgroup(content); got != want {
+			t.Errorf("containerIDFromCgroup(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
+
+// fakeDocker serves the Docker API on a unix socket, knowing a single
+// container, and counts the requests it receives.
+func fakeDocker(t *testing.T) (string, *int32) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/containers/"+testContainerID+"/json" {
+			http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Id":"` + testContainerID + `","Name":"/trainer"}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket, &requests
+}
+
+func TestContainerResolver(t *testing.T) {
+	socket, requests := fakeDocker(t)
+	procRoot := t.TempDir()
+	writeProcFile(t, procRoot, "100", "cgroup", "12:pids:/docker/"+testContainerID+"\n")
+	writeProcFile(t, procRoot, "200", "cgroup", "0::/system.slice/docker-"+testContainerID+".scope\n")
+	writeProcFile(t, procRoot, "300", "cgroup", "0::/user.slice/user-1000.slice/session-2.scope\n")
+	unknown := "0000000000000000000000000000000000000000000000000000000000000000"
+	writeProcFile(t, procRoot, "400", "cgroup", "0::/system.slice/containerd-"+unknown+".scope\n")
+
+	resolver := newContainerResolver(procRoot, socket)
+	tests := []struct {
+		pid  string
+		id   string
+		name string
+	}{
+		{"100", testContainerID, "trainer"},
+		{"200", testContainerID, "trainer"},
+		{"300", "", ""},
+		{"400", unknown, ""},
+		{"400", unknown, ""},
+		{"500", "", ""},
+	}
+	for _, test := range tests {
+		id, name := resolver.resolve(test.pid)
+		if id != test.id || name != test.name {
+			t.Errorf("resolve(%s) = %q, %q, want %q, %q", test.pid, id, name, test.id, test.name)
+		}
+	}
+	// One lookup for the known container, one for the unknown one, which
+	// is not repeated while the failure is cached
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Errorf("Docker received %d requests, want 2", got)
+	}
+}
+
+func TestContainerResolverExpiry(t *testing.T) {
+	socket, requests := fakeDocker(t)
+	resolver := newContainerResolver(t.TempDir(), socket)
+	resolver.names["gone"] = containerName{name: "old"}
+	resolver.names[testContainerID] = containerName{name: "stale"}
+
+	if name := resolver.containerName(testContainerID); name != "trainer" {
+		t.Errorf("got %q, want the name looked up again", name)
+	}
+	if _, ok := resolver.names["gone"]; ok {
+		t.Error("expired entries are not pruned")
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("Docker received %d requests, want 1", got)
+	}
+}
+
+func TestSanitizeProcessName(t *testing.T) {
+	defer func(basename bool, procRoot string, redact *regexp.Regexp) {
+		processNameBasename, processNameProcRoot, processNameRedact = basename, procRoot, redact
+	}(processNameBasename, processNameProcRoot, processNameRedact)
+
+	processNameProcRoot = t.TempDir()
+	writeProcFile(t, processNameProcRoot, "100", "comm", "app-worker\n")
+	if err := os.Symlink("/opt/My App/bin/app", filepath.Join(processNameProcRoot, "100", "exe")); err != nil {
+		t.Fatal(err)
+	}
+	writeProcFile(t, processNameProcRoot, "200", "comm", "python3\n")
+	commandLine := "/opt/My App/bin/app --token=secret"
+
+	tests := []struct {
+		basename bool
+		redact   string
+		pid      string
+		want     string
+	}{
+		{false, "", "100", commandLine},
+		{false, `--token=\S+`, "100", "/opt/My App/bin/app ***"},
+		{true, "", "100", "app"},
+		{true, "", "200", "python3"},
+		// Without a readable proc filesystem
+		{true, "", "300", "My"},
+	}
+	for _, test := range tests {
+		processNameBasename = test.basename
+		processNameRedact = nil
+		if test.redact != "" {
+			processNameRedact = regexp.MustCompile(test.redact)
+		}
+		if got := sanitizeProcessName(test.pid, commandLine); got != test.want {
+			t.Errorf("sanitizeProcessName(%s) with basename %v and redaction %q = %q, want %q", test.pid, test.basename, test.redact, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Minimal protocol buffers wire format support, for the few messages the
+// exporter exchanges with gRPC and remote endpoints.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func protoAppendTag(b []byte, field int, wireType int) []byte {
+	return protoAppendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func protoAppendVarintField(b []byte, field int, v uint64) []byte {
+	b = protoAppendTag(b, field, protoVarint)
+	return protoAppendVarint(b, v)
+}
+
+func protoAppendBytesField(b []byte, field int, v []byte) []byte {
+	b = protoAppendTag(b, field, protoBytes)
+	b = protoAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendStringField(b []byte, field int, v string) []byte {
+	return protoAppendBytesField(b, field, []byte(v))
+}
+
+func protoAppendFixed64Field(b []byte, field int, v uint64) []byte {
+	b = protoAppendTag(b, field, protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func protoAppendDoubleField(b []byte, field int, v float64) []byte {
+	return protoAppendFixed64Field(b, field, math.Float64bits(v))
+}
+
+func protoReadVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errProtoTruncated
+}
+
+// protoFields calls fn for each field of a message. Length-delimited fields
+// are passed as data, other fields as value.
+func protoFields(b []byte, fn func(field int, value uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n, err := protoReadVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		var value uint64
+		var data []byte
+		switch int(tag & 7) {
+		case protoVarint:
+			value, n, err = protoReadVarint(b)
+			if err != nil {
+				return err
+			}
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			value, n = binary.LittleEndian.Uint64(b), 8
+		case protoFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			value, n = uint64(binary.LittleEndian.Uint32(b)), 4
+		case protoBytes:
+			length, m, err := protoReadVarint(b)
+			if err != nil {
+				return err
+			}
+			if uint64(len(b)-m) < length {
+				return errProtoTruncated
+			}
+			data, n = b[m:m+int(length)], m+int(length)
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+		b = b[n:]
+		if err := fn(field, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
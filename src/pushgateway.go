@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const PUSHGATEWAY_TIMEOUT = 10 * time.Second
+
+// pushgateway pushes the metrics to a Prometheus Pushgateway, grouped by job
+// and instance.
+type pushgateway struct {
+	client *http.Client
+	url    string
+}
+
+// pushgatewayGroupingKey encodes a grouping key label in a Pushgateway URL
+// path, in base64 when the value cannot be used as is as a path segment, such
+// as values with "/", "?", "#" or "%". An empty value is written as "=", the
+// base64 padding, since empty path segments are not allowed.
+func pushgatewayGroupingKey(name string, value string) string {
+	switch {
+	case value == "":
+		return "/" + name + "@base64/="
+	case url.PathEscape(value) != value:
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + value
+}
+
+func newPushgateway(baseURL string, job string, instance string) *pushgateway {
+	return &pushgateway{
+		client: &http.Client{Timeout: PUSHGATEWAY_TIMEOUT},
+		url:    strings.TrimSuffix(baseURL, "/") + "/metrics" + pushgatewayGroupingKey("job", job) + pushgatewayGroupingKey("instance", instance),
+	}
+}
+
+func (p *pushgateway) do(method string, body io.Reader) error {
+	request, err := http.NewRequest(method, p.url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return errors.New(response.Status + " " + strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// push replaces the metrics of the group with the current ones.
+func (p *pushgateway) push() error {
+	m, err := collect()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	writeMetricSet(&body, m)
+	return p.do("PUT", &body)
+}
+
+// delete removes the metrics of the group.
+func (p *pushgateway) delete() error {
+	return p.do("DELETE", nil)
+}
+
+// run pushes at an interval until the exporter is stopped, then deletes the
+// group or pushes a last time.
+func (p *pushgateway) run(interval time.Duration, deleteOnShutdown bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.push(); err != nil {
+				log.Print("Pushgateway: " + err.Error())
+			}
+		case <-signals:
+			var err error
+			if deleteOnShutdown {
+				err = p.delete()
+			} else {
+				err = p.push()
+			}
+			if err != nil {
+				log.Print("Pushgateway: " + err.Error())
+			}
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushgatewayGroupingKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"job", "nvidiasmi", "/job/nvidiasmi"},
+		{"instance", "gpu-host:9202", "/instance/gpu-host:9202"},
+		{"instance", "", "/instance@base64/="},
+		{"instance", "rack/1", "/instance@base64/cmFjay8x"},
+		{"instance", "a?b", "/instance@base64/YT9i"},
+		{"instance", "a#b", "/instance@base64/YSNi"},
+		{"instance", "50%", "/instance@base64/NTAl"},
+		{"instance", "gpu host", "/instance@base64/Z3B1IGhvc3Q"},
+	}
+	for _, test := range tests {
+		if got := pushgatewayGroupingKey(test.name, test.value); got != test.want {
+			t.Errorf("pushgatewayGroupingKey(%q, %q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestPushgatewayDelete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || r.URL.Path != "/metrics/job/nvidiasmi/instance@base64/=" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	if err := newPushgateway(server.URL+"/", "nvidiasmi", "").delete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushgatewayInstanceEscaping(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	for _, instance := range []string{"a?b", "a#b", "50%", "gpu host", "rack/1"} {
+		if err := newPushgateway(server.URL, "nvidiasmi", instance).delete(); err != nil {
+			t.Errorf("%q: %v", instance, err)
+			continue
+		}
+		encoded, found := strings.CutPrefix(path, "/metrics/job/nvidiasmi/instance@base64/")
+		value, err := base64.RawURLEncoding.DecodeString(encoded)
+		if !found || err != nil || string(value) != instance {
+			t.Errorf("%q was sent as %s", instance, path)
+		}
+	}
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	defer func(mode string, registered []collector) { testMode, collectors = mode, registered }(testMode, collectors)
+	testMode = "1"
+	collectors = []collector{{nil, collectGPUs}}
+	t.Chdir("..")
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/metrics/job/nvidiasmi/instance/gpu-host" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "text/plain; version=0.0.4" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		content, _ := io.ReadAll(r.Body)
+		body = string(content)
+	}))
+	defer server.Close()
+
+	if err := newPushgateway(server.URL, "nvidiasmi", "gpu-host").push(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	found := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, err := parseExpositionLine(line)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+		if name == "nvidiasmi_power_draw_watts" {
+			found = labels["uuid"] == "GPU-cf5ce50c-9d96-5da7-adb6-b662d5afe4bc" && value == 45.45
+		}
+	}
+	if !found {
+		t.Errorf("the power draw of the sample is missing from the push:\n%s", body)
+	}
+}
+
+func TestPushgatewayError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid or inconsistent", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := newPushgateway(server.URL, "nvidiasmi", "gpu-host").delete()
+	if err == nil || err.Error() != "400 Bad Request pushed metrics are invalid or inconsistent" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REMOTE_WRITE_TIMEOUT = 30 * time.Second
+const REMOTE_WRITE_MIN_BACKOFF = 1 * time.Second
+const REMOTE_WRITE_MAX_BACKOFF = 1 * time.Minute
+
+// Size of the snappy match table, in bits of the hashed 4-byte sequences
+const SNAPPY_HASH_BITS = 14
+
+// snappyEncode compresses data in the snappy block format required by remote
+// write. Matches are found through a hash table of 4-byte sequences, within
+// the 64 KiB reachable by 2-byte copy offsets.
+func snappyEncode(data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(data)))
+	var table [1 << SNAPPY_HASH_BITS]int32
+	literal := 0
+	for i := 0; i+4 <= len(data); {
+		u := binary.LittleEndian.Uint32(data[i:])
+		h := (u * 0x1e35a7bd) >> (32 - SNAPPY_HASH_BITS)
+		// Positions are stored plus one, zero meaning none
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 0xffff || binary.LittleEndian.Uint32(data[candidate:]) != u {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(data) && data[candidate+length] == data[i+length] {
+			length++
+		}
+		b = snappyAppendLiteral(b, data[literal:i])
+		b = snappyAppendCopy(b, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyAppendLiteral(b, data[literal:])
+}
+
+func snappyAppendLiteral(b []byte, literal []byte) []byte {
+	n := len(literal) - 1
+	switch {
+	case n < 0:
+		return b
+	case n < 60:
+		b = append(b, byte(n)<<2)
+	case n < 1<<8:
+		b = append(b, 60<<2, byte(n))
+	case n < 1<<16:
+		b = append(b, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		b = append(b, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		b = append(b, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(b, literal...)
+}
+
+// snappyAppendCopy appends copies of at most 64 bytes, using the 1-byte offset
+// form when it fits.
+func snappyAppendCopy(b []byte, offset int, length int) []byte {
+	for length >= 68 {
+		b = append(b, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		// Leave at least 4 bytes for the last copy
+		b = append(b, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length <= 11 && offset < 2048 {
+		return append(b, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+	}
+	return append(b, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
+
+// encodeWriteRequest encodes the samples as a remote write WriteRequest.
+func encodeWriteRequest(m *metricSet, now time.Time) []byte {
+	var request []byte
+	for _, s := range m.samples {
+		value, err := strconv.ParseFloat(s.value, 64)
+		if err != nil {
+			continue
+		}
+		// Labels must be sorted by name
+		labels := withLabels([]label{{"__name__", s.name}}, s.labels...)
+		sort.SliceStable(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		var series []byte
+		// TimeSeries.labels = 1, samples = 2
+		for _, l := range labels {
+			// Label.name = 1, value = 2
+			encoded := protoAppendStringField(nil, 1, l.name)
+			encoded = protoAppendStringField(encoded, 2, l.value)
+			series = protoAppendBytesField(series, 1, encoded)
+		}
+		// Sample.value = 1, timestamp = 2 (milliseconds)
+		encoded := protoAppendDoubleField(nil, 1, value)
+		encoded = protoAppendVarintField(encoded, 2, uint64(now.UnixMilli()))
+		series = protoAppendBytesField(series, 2, encoded)
+		// WriteRequest.timeseries = 1
+		request = protoAppendBytesField(request, 1, series)
+	}
+	return request
+}
+
+// remoteWriter samples the metrics at an interval and sends them to a remote
+// write endpoint. Requests are queued in memory while the endpoint is
+// unavailable, dropping the oldest ones once the queue is full.
+type remoteWriter struct {
+	client     *http.Client
+	url        string
+	headers    http.Header
+	interval   time.Duration
+	queueSize  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	mu         sync.Mutex
+	queue      [][]byte
+	queued     chan struct{}
+}
+
+func newRemoteWriter(url string, headers http.Header, interval time.Duration, queueSize int) *remoteWriter {
+	return &remoteWriter{
+		client:     &http.Client{Timeout: REMOTE_WRITE_TIMEOUT},
+		url:        url,
+		headers:    headers,
+		interval:   interval,
+		queueSize:  queueSize,
+		minBackoff: REMOTE_WRITE_MIN_BACKOFF,
+		maxBackoff: REMOTE_WRITE_MAX_BACKOFF,
+		queued:     make(chan struct{}, 1),
+	}
+}
+
+func (r *remoteWriter) run() {
+	go r.send()
+	for range time.Tick(r.interval) {
+		m, err := collect()
+		if err != nil {
+			log.Print("Remote write: " + err.Error())
+			continue
+		}
+		r.enqueue(snappyEncode(encodeWriteRequest(m, time.Now())))
+	}
+}
+
+func (r *remoteWriter) enqueue(request []byte) {
+	r.mu.Lock()
+	if len(r.queue) >= r.queueSize {
+		r.queue = r.queue[1:]
+		log.Print("Remote write: queue full, dropping the oldest request")
+	}
+	r.queue = append(r.queue, request)
+	r.mu.Unlock()
+
+	select {
+	case r.queued <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest queued request, waiting for one if needed.
+func (r *remoteWriter) next() []byte {
+	for {
+		r.mu.Lock()
+		if len(r.queue) > 0 {
+			request := r.queue[0]
+			r.mu.Unlock()
+			return request
+		}
+		r.mu.Unlock()
+		<-r.queued
+	}
+}
+
+// dequeue removes a sent request, unless it was already dropped from a full
+// queue while being retried.
+func (r *remoteWriter) dequeue(request []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queue) > 0 && &r.queue[0][0] == &request[0] {
+		r.queue = r.queue[1:]
+	}
+}
+
+// send posts the queued requests in order, retrying with exponential backoff
+// on network errors, 429 and 5xx responses.
+func (r *remoteWriter) send() {
+	backoff := r.minBackoff
+	for {
+		request := r.next()
+		retry, err := r.post(request)
+		if err != nil {
+			log.Print("Remote write: " + err.Error())
+		}
+		if retry {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, r.maxBackoff)
+			continue
+		}
+		r.dequeue(request)
+		backoff = r.minBackoff
+	}
+}
+
+// post sends a request and tells whether it should be retried.
+func (r *remoteWriter) post(request []byte) (bool, error) {
+	httpRequest, err := http.NewRequest("POST", r.url, bytes.NewReader(request))
+	if err != nil {
+		return false, err
+	}
+	for key, values := range r.headers {
+		httpRequest.Header[key] = values
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	httpRequest.Header.Set("Content-Encoding", "snappy")
+	httpRequest.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	httpRequest.Header.Set("User-Agent", "prometheus-nvidiasmi")
+
+	response, err := r.client.Do(httpRequest)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	err = errors.New(response.Status + " " + strings.TrimSpace(string(message)))
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode/100 == 5, err
+}
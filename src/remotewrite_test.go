@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snappyDecode decodes a snappy block, as specified by the snappy format
+// description.
+func snappyDecode(b []byte) ([]byte, error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	b = b[n:]
+	var data []byte
+	for len(b) > 0 {
+		tag := b[0]
+		var offset, size int
+		switch tag & 3 {
+		case 0:
+			size = int(tag>>2) + 1
+			b = b[1:]
+			if size > 60 {
+				extra := size - 60
+				if len(b) < extra {
+					return nil, errors.New("truncated literal length")
+				}
+				size = 1
+				for i := 0; i < extra; i++ {
+					size += int(b[i]) << (8 * i)
+				}
+				b = b[extra:]
+			}
+			if len(b) < size {
+				return nil, errors.New("truncated literal")
+			}
+			data = append(data, b[:size]...)
+			b = b[size:]
+			continue
+		case 1:
+			if len(b) < 2 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(b[1])
+			b = b[2:]
+		case 2:
+			if len(b) < 3 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(b[1:]))
+			b = b[3:]
+		case 3:
+			if len(b) < 5 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(b[1:]))
+			b = b[5:]
+		}
+		if offset == 0 || offset > len(data) {
+			return nil, errors.New("invalid copy offset")
+		}
+		// Copies may overlap their own output
+		for i := 0; i < size; i++ {
+			data = append(data, data[len(data)-offset])
+		}
+	}
+	if uint64(len(data)) != length {
+		return nil, errors.New("length mismatch")
+	}
+	return data, nil
+}
+
+func TestSnappyEncode(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	var series bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		series.WriteString(`nvidiasmi_power_draw_watts{uuid="GPU-cf5ce50c-9d96-5da7-adb6-b662d5afe4bc"} 45.12`)
+	}
+	inputs := map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("abc"),
+		"run":        bytes.Repeat([]byte{'a'}, 70000),
+		"random":     random,
+		"series":     series.Bytes(),
+		"long match": append(append([]byte("0123456789"), bytes.Repeat([]byte("0123456789"), 30)...), 'x'),
+	}
+	for name, input := range inputs {
+		encoded := snappyEncode(input)
+		decoded, err := snappyDecode(encoded)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+	if encoded := snappyEncode(series.Bytes()); len(encoded) > series.Len()/10 {
+		t.Errorf("repeated series compressed to %d bytes out of %d", len(encoded), series.Len())
+	}
+}
+
+// Outputs of the reference implementation, github.com/golang/snappy, for
+// inputs whose encoding does not depend on the match finding heuristics.
+var snappyReferenceVectors = []struct {
+	input   string
+	encoded string
+}{
+	{"", "\x00"},
+	{"abc", "\x03\x08abc"},
+	{
+		`nvidiasmi_power_draw_watts{uuid="GPU-0"} 45.12` + "\n" + `nvidiasmi_power_limit_watts{uuid="GPU-0"} 196` + "\n",
+		"]\xb8nvidiasmi_power_draw_watts{uuid=\"GPU-0\"} 45.12\n>/\x00\x10limitR0\x00\f196\n",
+	},
+	{strings.Repeat("a", 100), "d\x00a\xfe\x01\x00\x8a\x01\x00"},
+}
+
+func TestSnappyEncodeReference(t *testing.T) {
+	for _, vector := range snappyReferenceVectors {
+		if got := string(snappyEncode([]byte(vector.input))); got != vector.encoded {
+			t.Errorf("snappyEncode(%q) = %q, want %q", vector.input, got, vector.encoded)
+		}
+	}
+
+	// The reference implementation does not find the match of "pedi", which
+	// checks the decoder against an encoder other than snappyEncode
+	input := "Wikipedia is a free, web-based, collaborative, multilingual encyclopedia project."
+	decoded, err := snappyDecode([]byte("Q\xf0PWikipedia is a free, web-based, collaborative, multilingual encyclopedia project."))
+	if err != nil || string(decoded) != input {
+		t.Errorf("got %q, %v", decoded, err)
+	}
+}
+
+// The literal and copy elements of the reference implementation, from the
+// emitLiteral and emitCopy tests of github.com/golang/snappy.
+func TestSnappyElementsReference(t *testing.T) {
+	literals := []struct {
+		length int
+		want   string
+	}{
+		{1, "\x00"}, {2, "\x04"}, {59, "\xe8"}, {60, "\xec"}, {61, "\xf0\x3c"}, {62, "\xf0\x3d"},
+		{254, "\xf0\xfd"}, {255, "\xf0\xfe"}, {256, "\xf0\xff"}, {257, "\xf4\x00\x01"},
+		{65534, "\xf4\xfd\xff"}, {65535, "\xf4\xfe\xff"}, {65536, "\xf4\xff\xff"},
+	}
+	nines := bytes.Repeat([]byte{0x99}, 65536)
+	for _, test := range literals {
+		got := snappyAppendLiteral(nil, nines[:test.length])
+		if !bytes.HasSuffix(got, nines[:test.length]) || string(got[:len(got)-test.length]) != test.want {
+			t.Errorf("literal of %d bytes: got tag % x, want % x", test.length, got[:len(got)-test.length], test.want)
+		}
+	}
+
+	copies := []struct {
+		offset int
+		length int
+		want   string
+	}{
+		{8, 4, "\x01\x08"}, {8, 11, "\x1d\x08"}, {8, 12, "\x2e\x08\x00"}, {8, 13, "\x32\x08\x00"},
+		{8, 59, "\xea\x08\x00"}, {8, 60, "\xee\x08\x00"}, {8, 61, "\xf2\x08\x00"}, {8, 62, "\xf6\x08\x00"},
+		{8, 63, "\xfa\x08\x00"}, {8, 64, "\xfe\x08\x00"}, {8, 65, "\xee\x08\x00\x05\x08"},
+		{8, 66, "\xee\x08\x00\x09\x08"}, {8, 67, "\xee\x08\x00\x0d\x08"}, {8, 68, "\xfe\x08\x00\x01\x08"},
+		{8, 69, "\xfe\x08\x00\x05\x08"}, {8, 80, "\xfe\x08\x00\x3e\x08\x00"},
+		{256, 4, "\x21\x00"}, {256, 11, "\x3d\x00"}, {256, 12, "\x2e\x00\x01"}, {256, 13, "\x32\x00\x01"},
+		{256, 59, "\xea\x00\x01"}, {256, 60, "\xee\x00\x01"}, {256, 61, "\xf2\x00\x01"}, {256, 62, "\xf6\x00\x01"},
+		{256, 63, "\xfa\x00\x01"}, {256, 64, "\xfe\x00\x01"}, {256, 65, "\xee\x00\x01\x25\x00"},
+		{256, 66, "\xee\x00\x01\x29\x00"}, {256, 67, "\xee\x00\x01\x2d\x00"}, {256, 68, "\xfe\x00\x01\x21\x00"},
+		{256, 69, "\xfe\x00\x01\x25\x00"}, {256, 80, "\xfe\x00\x01\x3e\x00\x01"},
+		{2048, 4, "\x0e\x00\x08"}, {2048, 11, "\x2a\x00\x08"}, {2048, 12, "\x2e\x00\x08"}, {2048, 13, "\x32\x00\x08"},
+		{2048, 59, "\xea\x00\x08"}, {2048, 60, "\xee\x00\x08"}, {2048, 61, "\xf2\x00\x08"}, {2048, 62, "\xf6\x00\x08"},
+		{2048, 63, "\xfa\x00\x08"}, {2048, 64, "\xfe\x00\x08"}, {2048, 65, "\xee\x00\x08\x12\x00\x08"},
+		{2048, 66, "\xee\x00\x08\x16\x00\x08"}, {2048, 67, "\xee\x00\x08\x1a\x00\x08"}, {2048, 68, "\xfe\x00\x08\x0e\x00\x08"},
+		{2048, 69, "\xfe\x00\x08\x12\x00\x08"}, {2048, 80, "\xfe\x00\x08\x3e\x00\x08"},
+	}
+	for _, test := range copies {
+		if got := string(snappyAppendCopy(nil, test.offset, test.length)); got != test.want {
+			t.Errorf("copy of %d bytes at offset %d: got % x, want % x", test.length, test.offset, got, test.want)
+		}
+	}
+}
+
+// remoteWriteReceiver answers remote write requests with the given status
+// codes in turn, then 204, and records the decoded requests.
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests [][]byte
+	received chan struct{}
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	decoded, err := snappyDecode(body)
+	if err != nil || request.Header.Get("Content-Encoding") != "snappy" || request.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.requests = append(r.requests, decoded)
+	r.mu.Unlock()
+	w.WriteHeader(status)
+	r.received <- struct{}{}
+}
+
+func (r *remoteWriteReceiver) wait(t *testing.T, count int) [][]byte {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d requests, want %d", i, count)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func newTestRemoteWriter(t *testing.T, statuses ...int) (*remoteWriter, *remoteWriteReceiver) {
+	receiver := &remoteWriteReceiver{statuses: statuses, received: make(chan struct{}, 16)}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	r := newRemoteWriter(server.URL, http.Header{"Authorization": {"Bearer token"}}, time.Minute, 2)
+	r.minBackoff = 10 * time.Millisecond
+	r.maxBackoff = 20 * time.Millisecond
+	return r, receiver
+}
+
+func queueLength(r *remoteWriter) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queue)
+}
+
+func waitQueueLength(t *testing.T, r *remoteWriter, length int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for queueLength(r) != length {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue has %d requests, want %d", queueLength(r), length)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteWriterSend(t *testing.T) {
+	r, receiver := newTestRemoteWriter(t)
+	m := &metricSet{}
+	m.add("nvidiasmi_power_draw_watts", []label{{"uuid", "GPU-0"}}, "45.12")
+	request := encodeWriteRequest(m, time.Unix(1700000000, 0))
+	r.enqueue(snappyEncode(request))
+	go r.send()
+
+	requests := receiver.wait(t, 1)
+	if !bytes.Equal(requests[0], request) {
+		t.Errorf("got request %x, want %x", requests[0], request)
+	}
+	waitQueueLength(t, r, 0)
+}
+
+func TestRemoteWriterRetry(t *testing.T) {
+	r, receiver := newTestRemoteWriter(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusInternalServerError)
+	r.enqueue(snappyEncode([]byte("first")))
+	r.enqueue(snappyEncode([]byte("second")))
+	start := time.Now()
+	go r.send()
+
+	requests := receiver.wait(t, 5)
+	want := []string{"first", "first", "first", "first", "second"}
+	for i := range want {
+		if string(requests[i]) != want[i] {
+			t.Errorf("request %d is %q, want %q", i, requests[i], want[i])
+		}
+	}
+	// Backoff of 10ms, then 20ms twice
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("retried within %v", elapsed)
+	}
+	waitQueueLength(t, r, 0)
+}
+
+func TestRemoteWriterDrop(t *testing.T) {
+	r, receiver := newTestRemoteWriter(t, http.StatusBadRequest)
+	r.enqueue(snappyEncode([]byte("rejected")))
+	r.enqueue(snappyEncode([]byte("accepted")))
+	go r.send()
+
+	// Client errors are not retried
+	requests := receiver.wait(t, 2)
+	if string(requests[0]) != "rejected" || string(requests[1]) != "accepted" {
+		t.Errorf("got requests %q", requests)
+	}
+	waitQueueLength(t, r, 0)
+}
+
+func TestRemoteWriterQueueFull(t *testing.T) {
+	r := newRemoteWriter("http://localhost", nil, time.Minute, 2)
+	for _, request := range []string{"first", "second", "third"} {
+		r.enqueue([]byte(request))
+	}
+	if len(r.queue) != 2 || string(r.queue[0]) != "second" || string(r.queue[1]) != "third" {
+		t.Errorf("got queue %q, want the oldest request dropped", r.queue)
+	}
+
+	// A request dropped while being retried is not dequeued again
+	request := r.next()
+	r.enqueue([]byte("fourth"))
+	r.dequeue(request)
+	if len(r.queue) != 2 || string(r.queue[0]) != "third" || string(r.queue[1]) != "fourth" {
+		t.Errorf("got queue %q", r.queue)
+	}
+}
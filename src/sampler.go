@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+)
+
+// sampleHandlers are fed every report taken by the background sampler, for
+// collectors which integrate readings over time rather than per scrape.
+var sampleHandlers []func(now time.Time, xmlData *NvidiaSmiLog)
+
+func runSampler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		xmlData, err := queryNvidiaSmi()
+		if err != nil {
+			logQueryError(err)
+		} else {
+			now := time.Now()
+			for _, handler := range sampleHandlers {
+				handler(now, xmlData)
+			}
+		}
+		<-ticker.C
+	}
+}
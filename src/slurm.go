@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var slurm *slurmResolver
+
+// Slurm cgroup paths look like /slurm/uid_<uid>/job_<id>/step_<step> with
+// cgroup v1, or /system.slice/slurmstepd.scope/job_<id>/step_<step> with v2.
+var slurmJobRegexp = regexp.MustCompile(`/job_(\d+)(/|$)`)
+var slurmUidRegexp = regexp.MustCompile(`/uid_(\d+)/`)
+
+type slurmJob struct {
+	id        string
+	user      string
+	partition string
+}
+
+// slurmResolver maps host PIDs to the Slurm job they belong to.
+type slurmResolver struct {
+	procRoot string
+	owners   *ownerResolver
+}
+
+func newSlurmResolver(procRoot string) *slurmResolver {
+	return &slurmResolver{procRoot: procRoot, owners: newOwnerResolver(procRoot)}
+}
+
+// jobFromEnviron reads the job from the content of a /proc/<pid>/environ file.
+func jobFromEnviron(content string) slurmJob {
+	var job slurmJob
+	for _, variable := range strings.Split(content, "\x00") {
+		pair := strings.SplitN(variable, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "SLURM_JOB_ID":
+			job.id = pair[1]
+		case "SLURM_JOB_USER":
+			job.user = pair[1]
+		case "SLURM_JOB_PARTITION":
+			job.partition = pair[1]
+		}
+	}
+	return job
+}
+
+// jobFromCgroup reads the job ID from the content of a /proc/<pid>/cgroup
+// file, along with the user ID when the cgroup path has one. The partition is
+// not part of the cgroup path.
+func jobFromCgroup(content string) (string, string) {
+	for _, line := range strings.Split(content, "\n") {
+		if match := slurmJobRegexp.FindStringSubmatch(line); match != nil {
+			uid := ""
+			if match := slurmUidRegexp.FindStringSubmatch(line); match != nil {
+				uid = match[1]
+			}
+			return match[1], uid
+		}
+	}
+	return "", ""
+}
+
+// resolve prefers the job environment, which is only readable with enough
+// privileges, and falls back on the cgroup path. The user then comes from the
+// cgroup path with cgroup v1, or from the owner of the process with v2.
+func (s *slurmResolver) resolve(pid string) slurmJob {
+	if content, err := os.ReadFile(s.procRoot + "/" + pid + "/environ"); err == nil {
+		if job := jobFromEnviron(string(content)); job.id != "" {
+			return job
+		}
+	}
+	content, err := os.ReadFile(s.procRoot + "/" + pid + "/cgroup")
+	if err != nil {
+		return slurmJob{}
+	}
+	id, uid := jobFromCgroup(string(content))
+	if id == "" {
+		return slurmJob{}
+	}
+	job := slurmJob{id: id}
+	if uid != "" {
+		job.user = s.owners.userName(uid)
+	} else {
+		_, job.user = s.owners.resolve(pid)
+	}
+	return job
+}
+
+func (job slurmJob) labels() []label {
+	return []label{{"slurm_job_id", job.id}, {"slurm_user", job.user}, {"slurm_partition", job.partition}}
+}
+
+var slurmFamilies = []string{
+	"nvidiasmi_slurm_job_used_memory_bytes",
+	"nvidiasmi_slurm_job_gpus",
+	"nvidiasmi_slurm_job_utilization_gpu_percent",
+}
+
+// collectSlurmJobs outputs the memory used by each job over all its GPUs,
+// the number of GPUs it runs on and their mean utilization. Jobs are keyed by
+// their labels, so that processes of a job resolved with different users or
+// partitions, such as when only some of them have a readable environment,
+// give the same series at every scrape whatever the order of the processes.
+func collectSlurmJobs(m *metricSet, xmlData *NvidiaSmiLog) {
+	jobs := make(map[string]slurmJob)
+	memory := make(map[string]float64)
+	utilization := make(map[string]float64)
+	gpus := make(map[string]map[string]bool)
+	for _, GPU := range xmlData.GPU {
+		for _, Process := range GPU.Processes.ProcessInfo {
+			job := slurm.resolve(Process.Pid)
+			if job.id == "" {
+				continue
+			}
+			key := job.id + "\x00" + job.user + "\x00" + job.partition
+			jobs[key] = job
+			used, _ := strconv.ParseFloat(filterUnit(Process.UsedMemory), 64)
+			memory[key] += used
+			if gpus[key] == nil {
+				gpus[key] = make(map[string]bool)
+			}
+			if !gpus[key][GPU.UUID] {
+				gpus[key][GPU.UUID] = true
+				value, _ := strconv.ParseFloat(filterUnit(GPU.Utilization.GPUUtil), 64)
+				utilization[key] += value
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(jobs) {
+		labels := jobs[key].labels()
+		m.add("nvidiasmi_slurm_job_used_memory_bytes", labels, fmt.Sprintf("%g", memory[key]))
+		m.add("nvidiasmi_slurm_job_gpus", labels, strconv.Itoa(len(gpus[key])))
+		m.add("nvidiasmi_slurm_job_utilization_gpu_percent", labels, fmt.Sprintf("%g", utilization[key]/float64(len(gpus[key]))))
+	}
+}
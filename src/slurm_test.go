@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// An uid unknown to the test host, exported as is
+const testSlurmUid = "40123"
+
+func TestJobFromEnviron(t *testing.T) {
+	content := "PATH=/usr/bin\x00SLURM_JOB_ID=1234\x00SLURM_JOB_USER=alice\x00SLURM_JOB_PARTITION=gpu\x00SLURM_JOB_NAME=a=b\x00"
+	want := slurmJob{id: "1234", user: "alice", partition: "gpu"}
+	if got := jobFromEnviron(content); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := jobFromEnviron("PATH=/usr/bin\x00"); got != (slurmJob{}) {
+		t.Errorf("got %+v outside of a job", got)
+	}
+}
+
+func TestJobFromCgroup(t *testing.T) {
+	tests := []struct {
+		content string
+		id      string
+		uid     string
+	}{
+		{"4:memory:/slurm/uid_1000/job_42/step_0/task_0\n1:cpuset:/slurm/uid_1000/job_42/step_0\n", "42", "1000"},
+		{"0::/system.slice/slurmstepd.scope/job_42/step_batch/user/task_0\n", "42", ""},
+		{"0::/system.slice/slurmstepd.scope/job_42\n", "42", ""},
+		{"0::/system.slice/slurmstepd.scope/job_42x/step_0\n", "", ""},
+		{"0::/user.slice/user-1000.slice/session-2.scope\n", "", ""},
+	}
+	for _, test := range tests {
+		id, uid := jobFromCgroup(test.content)
+		if id != test.id || uid != test.uid {
+			t.Errorf("jobFromCgroup(%q) = %q, %q, want %q, %q", test.content, id, uid, test.id, test.uid)
+		}
+	}
+}
+
+// slurmProcTree writes a PROC_ROOT with a process per way to find its job.
+func slurmProcTree(t *testing.T) string {
+	procRoot := t.TempDir()
+	// Readable environment
+	writeProcFile(t, procRoot, "100", "environ", "SLURM_JOB_ID=7\x00SLURM_JOB_USER=alice\x00SLURM_JOB_PARTITION=gpu\x00")
+	writeProcFile(t, procRoot, "100", "cgroup", "0::/system.slice/slurmstepd.scope/job_7/step_0\n")
+	// Another process of the same job, without a readable environment
+	writeProcFile(t, procRoot, "110", "cgroup", "0::/system.slice/slurmstepd.scope/job_7/step_1\n")
+	writeProcFile(t, procRoot, "110", "status", "Name:\tpython\nUid:\t"+testSlurmUid+"\t"+testSlurmUid+"\t"+testSlurmUid+"\t"+testSlurmUid+"\n")
+	// cgroup v1
+	writeProcFile(t, procRoot, "200", "cgroup", "4:memory:/slurm/uid_"+testSlurmUid+"/job_8/step_0\n")
+	// cgroup v2, with the owner from the process status
+	writeProcFile(t, procRoot, "300", "cgroup", "0::/system.slice/slurmstepd.scope/job_9/step_0\n")
+	writeProcFile(t, procRoot, "300", "status", "Name:\tpython\nUid:\t"+testSlurmUid+"\t"+testSlurmUid+"\t"+testSlurmUid+"\t"+testSlurmUid+"\n")
+	// Outside of Slurm
+	writeProcFile(t, procRoot, "400", "cgroup", "0::/user.slice/user-1000.slice/session-2.scope\n")
+	return procRoot
+}
+
+func TestSlurmResolver(t *testing.T) {
+	resolver := newSlurmResolver(slurmProcTree(t))
+	tests := map[string]slurmJob{
+		"100": {id: "7", user: "alice", partition: "gpu"},
+		"110": {id: "7", user: testSlurmUid},
+		"200": {id: "8", user: testSlurmUid},
+		"300": {id: "9", user: testSlurmUid},
+		"400": {},
+		"500": {},
+	}
+	for pid, want := range tests {
+		if got := resolver.resolve(pid); got != want {
+			t.Errorf("resolve(%s) = %+v, want %+v", pid, got, want)
+		}
+	}
+}
+
+func TestCollectSlurmJobs(t *testing.T) {
+	defer func(previous *slurmResolver) { slurm = previous }(slurm)
+	slurm = newSlurmResolver(slurmProcTree(t))
+
+	xmlData := &NvidiaSmiLog{GPU: make([]GPUInfo, 2)}
+	xmlData.GPU[0].UUID = "GPU-0"
+	xmlData.GPU[0].Utilization.GPUUtil = "40 %"
+	xmlData.GPU[0].Processes.ProcessInfo = []ProcessInfo{
+		{Pid: "100", UsedMemory: "100 MiB"},
+		{Pid: "200", UsedMemory: "200 MiB"},
+		{Pid: "400", UsedMemory: "400 MiB"},
+	}
+	xmlData.GPU[1].UUID = "GPU-1"
+	xmlData.GPU[1].Utilization.GPUUtil = "80 %"
+	xmlData.GPU[1].Processes.ProcessInfo = []ProcessInfo{
+		{Pid: "100", UsedMemory: "300 MiB"},
+		{Pid: "101", UsedMemory: "1 MiB"},
+		{Pid: "110", UsedMemory: "50 MiB"},
+	}
+
+	m := &metricSet{}
+	collectSlurmJobs(m, xmlData)
+	alice := []label{{"slurm_job_id", "7"}, {"slurm_user", "alice"}, {"slurm_partition", "gpu"}}
+	sameJob := []label{{"slurm_job_id", "7"}, {"slurm_user", testSlurmUid}, {"slurm_partition", ""}}
+	other := []label{{"slurm_job_id", "8"}, {"slurm_user", testSlurmUid}, {"slurm_partition", ""}}
+	want := []sample{
+		{"nvidiasmi_slurm_job_used_memory_bytes", sameJob, "5.24288e+07"},
+		{"nvidiasmi_slurm_job_gpus", sameJob, "1"},
+		{"nvidiasmi_slurm_job_utilization_gpu_percent", sameJob, "80"},
+		{"nvidiasmi_slurm_job_used_memory_bytes", alice, "4.194304e+08"},
+		{"nvidiasmi_slurm_job_gpus", alice, "2"},
+		{"nvidiasmi_slurm_job_utilization_gpu_percent", alice, "60"},
+		{"nvidiasmi_slurm_job_used_memory_bytes", other, "2.097152e+08"},
+		{"nvidiasmi_slurm_job_gpus", other, "1"},
+		{"nvidiasmi_slurm_job_utilization_gpu_percent", other, "40"},
+	}
+	if !reflect.DeepEqual(m.samples, want) {
+		t.Errorf("got %v, want %v", m.samples, want)
+	}
+
+	// The series do not depend on the order of the processes
+	processes := xmlData.GPU[1].Processes.ProcessInfo
+	processes[0], processes[2] = processes[2], processes[0]
+	m = &metricSet{}
+	collectSlurmJobs(m, xmlData)
+	if !reflect.DeepEqual(m.samples, want) {
+		t.Errorf("got %v with the processes reordered, want %v", m.samples, want)
+	}
+}
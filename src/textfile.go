@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const TEXTFILE_NAME = "nvidiasmi.prom"
+
+// writeTextfile writes the metrics for the node_exporter textfile collector.
+// The file is written under a temporary name, ignored by node_exporter, and
+// renamed so that it is never read partially written.
+func writeTextfile(path string) error {
+	m, err := collect()
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	writeMetricSet(writer, m)
+	err = writer.Flush()
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// runTextfile writes the metrics once, or at an interval when not zero.
+func runTextfile(path string, interval time.Duration) {
+	for {
+		err := writeTextfile(path)
+		if interval == 0 {
+			if err != nil {
+				log.Fatal("Textfile: " + err.Error())
+			}
+			return
+		}
+		if err != nil {
+			log.Print("Textfile: " + err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var throttle *throttleCounter
+
+func throttleActive(state string) string {
+	if state == "Active" {
+		return "1"
+	}
+	return "0"
+}
+
+// throttleCounter accumulates the time each throttle reason was active. A
+// reason seen active in a sample is considered active until the next one.
+type throttleCounter struct {
+	mu       sync.Mutex
+	lastTime map[string]time.Time
+	active   map[string]map[string]bool
+	labels   map[string][]label
+	seconds  map[string]map[string]float64
+}
+
+func newThrottleCounter() *throttleCounter {
+	return &throttleCounter{
+		lastTime: make(map[string]time.Time),
+		active:   make(map[string]map[string]bool),
+		labels:   make(map[string][]label),
+		seconds:  make(map[string]map[string]float64),
+	}
+}
+
+func (t *throttleCounter) sample(now time.Time, xmlData *NvidiaSmiLog) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, GPU := range xmlData.GPU {
+		t.labels[GPU.UUID] = gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		if t.seconds[GPU.UUID] == nil {
+			t.seconds[GPU.UUID] = make(map[string]float64)
+		}
+
+		elapsed := 0.0
+		if last, ok := t.lastTime[GPU.UUID]; ok {
+			elapsed = now.Sub(last).Seconds()
+		}
+		active := make(map[string]bool)
+		for _, reason := range GPU.throttleReasons().reasons() {
+			// Unsupported reasons are reported as N/A
+			if reason[1] == "N/A" || reason[1] == "" {
+				continue
+			}
+			seconds := t.seconds[GPU.UUID][reason[0]]
+			if t.active[GPU.UUID][reason[0]] {
+				seconds += elapsed
+			}
+			t.seconds[GPU.UUID][reason[0]] = seconds
+			active[reason[0]] = reason[1] == "Active"
+		}
+		t.lastTime[GPU.UUID] = now
+		t.active[GPU.UUID] = active
+	}
+}
+
+func (t *throttleCounter) collect(m *metricSet, xmlData *NvidiaSmiLog) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, uuid := range sortedKeys(t.labels) {
+		seconds := t.seconds[uuid]
+		for _, reason := range (ClocksThrottleReasons{}).reasons() {
+			if value, ok := seconds[reason[0]]; ok {
+				m.add("nvidiasmi_clocks_throttle_seconds_total", withLabels(t.labels[uuid], label{"reason", reason[0]}), fmt.Sprintf("%g", value))
+			}
+		}
+	}
+}
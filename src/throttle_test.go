@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"testing"
+	"time"
+)
+
+func readSampleXML(t *testing.T, path string) *NvidiaSmiLog {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmlData NvidiaSmiLog
+	if err := xml.Unmarshal(content, &xmlData); err != nil {
+		t.Fatal(err)
+	}
+	return &xmlData
+}
+
+// throttleReasonStates returns the reason_active values by reason.
+func throttleReasonStates(m *metricSet) map[string]string {
+	states := make(map[string]string)
+	for _, s := range m.samples {
+		if s.name == "nvidiasmi_clocks_throttle_reason_active" {
+			states[s.labels[len(s.labels)-1].value] = s.value
+		}
+	}
+	return states
+}
+
+func TestThrottleReasons(t *testing.T) {
+	tests := []struct {
+		path   string
+		states map[string]string
+	}{
+		// clocks_throttle_reasons, before driver 535
+		{"../nvidia-smi.sample.xml", map[string]string{
+			"gpu_idle": "0", "applications_clocks_setting": "0", "sw_power_cap": "0", "hw_slowdown": "0",
+			"sync_boost": "0", "sw_thermal_slowdown": "0", "display_clocks_setting": "0",
+		}},
+		// clocks_event_reasons
+		{"../nvidia-smi-r535.sample.xml", map[string]string{
+			"gpu_idle": "0", "applications_clocks_setting": "0", "sw_power_cap": "1", "hw_slowdown": "0",
+			"hw_thermal_slowdown": "0", "hw_power_brake_slowdown": "0", "sync_boost": "0", "sw_thermal_slowdown": "0",
+		}},
+	}
+	for _, test := range tests {
+		m := &metricSet{}
+		collectGPUs(m, readSampleXML(t, test.path))
+		states := throttleReasonStates(m)
+		if len(states) != len(test.states) {
+			t.Errorf("%s: got reasons %v, want %v", test.path, states, test.states)
+			continue
+		}
+		for reason, state := range test.states {
+			if states[reason] != state {
+				t.Errorf("%s: %s is %q, want %q", test.path, reason, states[reason], state)
+			}
+		}
+	}
+}
+
+func TestThrottleCounterEventReasons(t *testing.T) {
+	xmlData := readSampleXML(t, "../nvidia-smi-r535.sample.xml")
+	counter := newThrottleCounter()
+	start := time.Unix(1700000000, 0)
+	counter.sample(start, xmlData)
+	counter.sample(start.Add(10*time.Second), xmlData)
+
+	m := &metricSet{}
+	counter.collect(m, xmlData)
+	seconds := make(map[string]string)
+	for _, s := range m.samples {
+		seconds[s.labels[len(s.labels)-1].value] = s.value
+	}
+	if seconds["sw_power_cap"] != "10" || seconds["gpu_idle"] != "0" {
+		t.Errorf("got throttle seconds %v", seconds)
+	}
+	if _, ok := seconds["display_clocks_setting"]; ok {
+		t.Error("an unsupported reason is counted")
+	}
+}
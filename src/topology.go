@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var topologyEnabled bool
+
+var topologyFamilies = []string{"nvidiasmi_topology_affinity_info", "nvidiasmi_topology_connection_info"}
+
+var topologyEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+type topologyGPU struct {
+	Index        int               `json:"index"`
+	Id           string            `json:"id"`
+	UUID         string            `json:"uuid"`
+	Name         string            `json:"name"`
+	CPUAffinity  string            `json:"cpu_affinity"`
+	NUMAAffinity string            `json:"numa_affinity"`
+	Links        map[string]string `json:"links"`
+}
+
+// The topology does not change while the host is up, so it is only
+// queried until it has been read successfully once.
+var topologyCache struct {
+	sync.Mutex
+	gpus []topologyGPU
+}
+
+// parseTopology reads the matrix printed by `nvidia-smi topo -m`: a header
+// row of device names followed by affinity columns, then one row per device.
+func parseTopology(output []byte) []topologyGPU {
+	var header []string
+	var rows [][]string
+	devices := make(map[string]bool)
+	for _, line := range strings.Split(topologyEscapeRegexp.ReplaceAllString(string(output), ""), "\n") {
+		if strings.TrimSpace(line) == "" {
+			if header != nil {
+				// The legend follows the matrix
+				break
+			}
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+		devices[fields[0]] = true
+		rows = append(rows, fields)
+	}
+
+	var gpus []topologyGPU
+	for _, fields := range rows {
+		if !strings.HasPrefix(fields[0], "GPU") {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(fields[0], "GPU"))
+		if err != nil {
+			continue
+		}
+		gpu := topologyGPU{Index: index, Links: make(map[string]string)}
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			switch {
+			case header[i] == "CPU Affinity":
+				gpu.CPUAffinity = fields[i]
+			case header[i] == "NUMA Affinity":
+				gpu.NUMAAffinity = fields[i]
+			case devices[header[i]] && header[i] != fields[0]:
+				gpu.Links[header[i]] = fields[i]
+			}
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus
+}
+
+func queryTopology(xmlData *NvidiaSmiLog) []topologyGPU {
+	topologyCache.Lock()
+	defer topologyCache.Unlock()
+	if topologyCache.gpus == nil {
+		stdout, err := nvidiaSmiCommand("nvidia-smi-topo.sample.txt", "topo", "-m").Output()
+		if err != nil {
+			log.Print("nvidia-smi topo: " + err.Error())
+			return nil
+		}
+		topologyCache.gpus = parseTopology(stdout)
+	}
+
+	// Only report the selected GPUs
+	var gpus []topologyGPU
+	for _, GPU := range xmlData.GPU {
+		index, ok := gpuIndex(GPU.UUID)
+		if !ok {
+			continue
+		}
+		for _, gpu := range topologyCache.gpus {
+			if gpu.Index == index {
+				gpu.Id = GPU.Id
+				gpu.UUID = GPU.UUID
+				gpu.Name = GPU.ProductName
+				gpus = append(gpus, gpu)
+			}
+		}
+	}
+	return gpus
+}
+
+func collectTopology(m *metricSet, xmlData *NvidiaSmiLog) {
+	gpus := queryTopology(xmlData)
+	uuids := make(map[string]string)
+	for _, gpu := range gpus {
+		uuids["GPU"+strconv.Itoa(gpu.Index)] = gpu.UUID
+	}
+
+	for _, gpu := range gpus {
+		meta := gpuLabels(gpu.Id, gpu.UUID, gpu.Name)
+		m.add("nvidiasmi_topology_affinity_info", withLabels(meta, label{"cpu_affinity", gpu.CPUAffinity}, label{"numa_affinity", gpu.NUMAAffinity}), "1")
+		for _, peer := range sortedKeys(gpu.Links) {
+			m.add("nvidiasmi_topology_connection_info", withLabels(meta, label{"peer", peer}, label{"peer_uuid", uuids[peer]}, label{"connection", gpu.Links[peer]}), "1")
+		}
+	}
+}
+
+func topologyAPI(w http.ResponseWriter, r *http.Request) {
+	log.Print("Serving /api/topology")
+
+	xmlData, err := queryNvidiaSmi()
+	if err != nil {
+		logQueryError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"gpus": queryTopology(xmlData)})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseTopologyFixture(t *testing.T) {
+	output, err := os.ReadFile("../nvidia-smi-topo.sample.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []topologyGPU{{
+		Index:        0,
+		CPUAffinity:  "0-11",
+		NUMAAffinity: "N/A",
+		Links:        map[string]string{"mlx5_0": "PHB"},
+	}}
+	if got := parseTopology(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseTopologyMultipleGPUs(t *testing.T) {
+	output := []byte("\t\x1b[4mGPU0\tGPU1\tGPU2\tGPU3\tNIC0\tCPU Affinity\tNUMA Affinity\tGPU NUMA ID\x1b[0m\n" +
+		"GPU0\t X \tNV12\tNV12\tSYS\tPXB\t0-23,48-71\t0\t\tN/A\n" +
+		"GPU1\tNV12\t X \tNV12\tSYS\tSYS\t0-23,48-71\t0\t\tN/A\n" +
+		"GPU2\tNV12\tNV12\t X \tSYS\tSYS\t0-23,48-71\t0\t\tN/A\n" +
+		"GPU3\tSYS\tSYS\tSYS\t X \tSYS\t24-47,72-95\t1\t\tN/A\n" +
+		"NIC0\tPXB\tSYS\tSYS\tSYS\t X \t\t\t\t\n" +
+		"\n" +
+		"Legend:\n" +
+		"\n" +
+		"  X    = Self\n" +
+		"  NV#  = Connection traversing a bonded set of # NVLinks\n" +
+		"\n" +
+		"NIC Legend:\n" +
+		"\n" +
+		"  NIC0: mlx5_0\n")
+	gpus := parseTopology(output)
+	if len(gpus) != 4 {
+		t.Fatalf("got %d GPUs, want 4: %+v", len(gpus), gpus)
+	}
+
+	want := map[int]topologyGPU{
+		0: {
+			Index:        0,
+			CPUAffinity:  "0-23,48-71",
+			NUMAAffinity: "0",
+			Links:        map[string]string{"GPU1": "NV12", "GPU2": "NV12", "GPU3": "SYS", "NIC0": "PXB"},
+		},
+		3: {
+			Index:        3,
+			CPUAffinity:  "24-47,72-95",
+			NUMAAffinity: "1",
+			Links:        map[string]string{"GPU0": "SYS", "GPU1": "SYS", "GPU2": "SYS", "NIC0": "SYS"},
+		},
+	}
+	for i, gpu := range want {
+		if !reflect.DeepEqual(gpus[i], gpu) {
+			t.Errorf("GPU%d is %+v, want %+v", i, gpus[i], gpu)
+		}
+	}
+
+	// Links are symmetric
+	for _, gpu := range gpus {
+		for peer, connection := range gpu.Links {
+			for _, other := range gpus {
+				if "GPU"+strconv.Itoa(other.Index) == peer && other.Links["GPU"+strconv.Itoa(gpu.Index)] != connection {
+					t.Errorf("GPU%d to %s is %s, but not the other way", gpu.Index, peer, connection)
+				}
+			}
+		}
+	}
+}
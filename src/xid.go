@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const XID_RESTART_DELAY = 5 * time.Second
+const XID_POLL_INTERVAL = 1 * time.Second
+
+var xids *xidMonitor
+
+var xidFamilies = []string{"nvidiasmi_xid_errors_total", "nvidiasmi_xid_last_timestamp_seconds"}
+
+// Xid lines look like "NVRM: Xid (PCI:0000:01:00): 79, pid=..., GPU has
+// fallen off the bus."
+var xidRegexp = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)[^)]*\): (\d+)`)
+
+// The driver logs the UUID of each GPU when it loads, which identifies the
+// GPUs gone from nvidia-smi.
+var xidGPURegexp = regexp.MustCompile(`NVRM: GPU at PCI:([0-9a-fA-F:.]+): (GPU-[0-9a-fA-F-]+)`)
+
+// /dev/kmsg records are prefixed with "priority,sequence,timestamp,flags;".
+var kmsgPrefixRegexp = regexp.MustCompile(`^\d+,(\d+),(\d+)[^;]*;`)
+
+// xidMonitor counts the Xid errors reported in the kernel log by each GPU,
+// keyed by PCI bus ID since GPUs which fell off the bus are gone from
+// nvidia-smi.
+type xidMonitor struct {
+	source   string
+	bootTime time.Time
+	// Position in the source, so that reopening it does not count the same
+	// records again: the last /dev/kmsg sequence number, and the file and
+	// offset read for regular files
+	sequence int64
+	file     os.FileInfo
+	offset   int64
+	mu       sync.Mutex
+	counts   map[string]map[string]int
+	last     map[string]time.Time
+	uuids    map[string]string
+}
+
+func newXidMonitor(source string) *xidMonitor {
+	return &xidMonitor{
+		source:   source,
+		bootTime: bootTime(),
+		sequence: -1,
+		counts:   make(map[string]map[string]int),
+		last:     make(map[string]time.Time),
+		uuids:    make(map[string]string),
+	}
+}
+
+// bootTime is used to convert the timestamps of /dev/kmsg records, in
+// microseconds since boot.
+func bootTime() time.Time {
+	content, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return time.Time{}
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(uptime * float64(time.Second)))
+}
+
+func (x *xidMonitor) run() {
+	for {
+		if err := x.tail(); err != nil {
+			log.Print("Xid " + x.source + ": " + err.Error())
+		}
+		time.Sleep(XID_RESTART_DELAY)
+	}
+}
+
+// tail follows the source until it fails, or until a regular file is
+// rotated. Reads on /dev/kmsg block until a record is available and always
+// start from the oldest record, while regular files are polled and resumed
+// where they were left, unless they were replaced or truncated.
+func (x *xidMonitor) tail() error {
+	file, err := os.Open(x.source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		if x.file == nil || !os.SameFile(x.file, info) || info.Size() < x.offset {
+			x.offset = 0
+		}
+		x.file = info
+		if _, err := file.Seek(x.offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	var line string
+	for {
+		chunk, err := reader.ReadString('\n')
+		line += chunk
+		switch {
+		case err == nil:
+			x.parse(line)
+			x.offset += int64(len(line))
+			line = ""
+		case err == io.EOF:
+			if info.Mode().IsRegular() && x.rotated(file) {
+				return nil
+			}
+			time.Sleep(XID_POLL_INTERVAL)
+		case errors.Is(err, syscall.EPIPE):
+			// Records were overwritten in the kernel ring buffer before being read
+			line = ""
+		default:
+			return err
+		}
+	}
+}
+
+// rotated tells whether the regular file being read was replaced or
+// truncated, and must be read again from the start.
+func (x *xidMonitor) rotated(file *os.File) bool {
+	current, err := os.Stat(x.source)
+	if err != nil {
+		// Files are briefly missing while rotated
+		return false
+	}
+	if !os.SameFile(x.file, current) {
+		return true
+	}
+	if info, err := file.Stat(); err == nil && info.Size() < x.offset {
+		x.offset = 0
+		return true
+	}
+	return false
+}
+
+// parse accounts for an Xid line, either a /dev/kmsg record or a plain line
+// as output by dmesg. /dev/kmsg records already read are skipped.
+func (x *xidMonitor) parse(line string) {
+	timestamp := time.Now()
+	if prefix := kmsgPrefixRegexp.FindStringSubmatch(line); prefix != nil {
+		sequence, _ := strconv.ParseInt(prefix[1], 10, 64)
+		if sequence <= x.sequence {
+			return
+		}
+		x.sequence = sequence
+		if usec, err := strconv.ParseInt(prefix[2], 10, 64); err == nil && !x.bootTime.IsZero() {
+			timestamp = x.bootTime.Add(time.Duration(usec) * time.Microsecond)
+		}
+	}
+
+	if match := xidGPURegexp.FindStringSubmatch(line); match != nil {
+		x.mu.Lock()
+		x.uuids[normalizePCIBusId(match[1])] = match[2]
+		x.mu.Unlock()
+		return
+	}
+	match := xidRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	busId := normalizePCIBusId(match[1])
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.counts[busId] == nil {
+		x.counts[busId] = make(map[string]int)
+	}
+	x.counts[busId][match[2]]++
+	if timestamp.After(x.last[busId]) {
+		x.last[busId] = timestamp
+	}
+}
+
+// collect outputs the Xid counts of each GPU. GPUs missing from nvidia-smi,
+// such as after Xid 79, are identified by their PCI bus ID, and by their UUID
+// when the kernel log still has it.
+func (x *xidMonitor) collect(m *metricSet, xmlData *NvidiaSmiLog) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// Unless the PCI bus ID is already exported under that name
+	busIdLabel := true
+	for _, l := range gpuLabelNames {
+		if l.name == "id" && l.value == "pci_bus_id" {
+			busIdLabel = false
+		}
+	}
+
+	for _, busId := range sortedKeys(x.counts) {
+		GPU := &GPUInfo{Id: busId, UUID: x.uuids[busId]}
+		for i := range xmlData.GPU {
+			if normalizePCIBusId(xmlData.GPU[i].Id) == busId {
+				GPU = &xmlData.GPU[i]
+			}
+		}
+		if !gpuSelected(GPU) {
+			continue
+		}
+		meta := gpuLabels(GPU.Id, GPU.UUID, GPU.ProductName)
+		if busIdLabel {
+			meta = withLabels(meta, label{"pci_bus_id", busId})
+		}
+		codes := sortedKeys(x.counts[busId])
+		sort.Slice(codes, func(i, j int) bool {
+			a, _ := strconv.Atoi(codes[i])
+			b, _ := strconv.Atoi(codes[j])
+			return a < b
+		})
+		for _, code := range codes {
+			m.add("nvidiasmi_xid_errors_total", withLabels(meta, label{"xid", code}), strconv.Itoa(x.counts[busId][code]))
+		}
+		m.add("nvidiasmi_xid_last_timestamp_seconds", meta, fmt.Sprintf("%.3f", float64(x.last[busId].UnixMilli())/1000))
+	}
+}
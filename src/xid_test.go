@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testXidGPU = "00000000:01:00.0"
+const testXidMissingGPU = "00000000:02:00.0"
+
+func parseXidSample(t *testing.T, x *xidMonitor) {
+	t.Helper()
+	content, err := os.ReadFile("../kmsg.sample.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		x.parse(line)
+	}
+}
+
+func TestXidParse(t *testing.T) {
+	x := newXidMonitor("../kmsg.sample.txt")
+	parseXidSample(t, x)
+	want := map[string]map[string]int{
+		testXidGPU:        {"13": 2, "31": 1},
+		testXidMissingGPU: {"79": 1},
+	}
+	if !reflect.DeepEqual(x.counts, want) {
+		t.Errorf("got counts %v, want %v", x.counts, want)
+	}
+	if x.uuids[testXidMissingGPU] != "GPU-6e8a1bd5-4c3f-2e9d-1a0b-7c6d5e4f3a2b" {
+		t.Errorf("got UUIDs %v", x.uuids)
+	}
+	if !x.bootTime.IsZero() {
+		if got := x.last[testXidGPU].Sub(x.bootTime); got != 250113004*time.Microsecond {
+			t.Errorf("last Xid at %v after boot, want 250.113004s", got)
+		}
+	}
+
+	// Reopening /dev/kmsg replays the ring buffer
+	parseXidSample(t, x)
+	if !reflect.DeepEqual(x.counts, want) {
+		t.Errorf("got counts %v after a replay, want %v", x.counts, want)
+	}
+
+	// Records may have a ";" in their message
+	x.parse("4,1961,391250000,-;NVRM: Xid (PCI:0000:01:00): 13, pid=2125, Graphics Exception; ESR 0x0\n")
+	if x.counts[testXidGPU]["13"] != 3 || x.sequence != 1961 {
+		t.Errorf("got counts %v and sequence %d after a record", x.counts, x.sequence)
+	}
+
+	// dmesg lines have no sequence number, even when looking like one
+	x.parse("[  412.112233] NVRM: Xid (PCI:0000:01:00): 13, pid=1, Graphics Exception; ESR 0x0\n")
+	x.parse("NVRM: Xid (PCI:0000:01:00): 13,2,3; Graphics Exception\n")
+	if x.counts[testXidGPU]["13"] != 5 || x.sequence != 1961 {
+		t.Errorf("got counts %v and sequence %d after dmesg lines", x.counts, x.sequence)
+	}
+}
+
+func TestXidCollect(t *testing.T) {
+	x := newXidMonitor("../kmsg.sample.txt")
+	parseXidSample(t, x)
+	content, err := os.ReadFile("../nvidia-smi.sample.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmlData NvidiaSmiLog
+	if err := xml.Unmarshal(content, &xmlData); err != nil {
+		t.Fatal(err)
+	}
+	GPU := xmlData.GPU[0]
+
+	m := &metricSet{}
+	x.collect(m, &xmlData)
+	present := []label{{"id", GPU.Id}, {"uuid", GPU.UUID}, {"name", GPU.ProductName}, {"pci_bus_id", testXidGPU}}
+	missing := []label{{"id", testXidMissingGPU}, {"uuid", "GPU-6e8a1bd5-4c3f-2e9d-1a0b-7c6d5e4f3a2b"}, {"name", ""}, {"pci_bus_id", testXidMissingGPU}}
+	want := []sample{
+		{"nvidiasmi_xid_errors_total", withLabels(present, label{"xid", "13"}), "2"},
+		{"nvidiasmi_xid_errors_total", withLabels(present, label{"xid", "31"}), "1"},
+		{"nvidiasmi_xid_errors_total", withLabels(missing, label{"xid", "79"}), "1"},
+	}
+	var got []sample
+	for _, s := range m.samples {
+		if s.name == "nvidiasmi_xid_errors_total" {
+			got = append(got, s)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// waitXidCount waits for the tail of a source to reach a count of Xid 13.
+func waitXidCount(t *testing.T, x *xidMonitor, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		x.mu.Lock()
+		got := x.counts[testXidGPU]["13"]
+		x.mu.Unlock()
+		if got == count {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Xid count did not reach %d", count)
+}
+
+func TestXidTailRotation(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "kern.log")
+	line := "[  412.112233] NVRM: Xid (PCI:0000:01:00): 13, pid=1, Graphics Exception\n"
+	if err := os.WriteFile(source, []byte(line+line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	x := newXidMonitor(source)
+	done := make(chan error, 1)
+	go func() { done <- x.tail() }()
+	waitXidCount(t, x, 2)
+
+	// A new file replacing the source is read from the start
+	rotated := source + ".new"
+	if err := os.WriteFile(rotated, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(rotated, source); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotation was not detected")
+	}
+	go func() { done <- x.tail() }()
+	waitXidCount(t, x, 3)
+
+	// And so is a truncated file
+	if err := os.WriteFile(source, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("truncation was not detected")
+	}
+	if err := os.WriteFile(source, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- x.tail() }()
+	waitXidCount(t, x, 4)
+}